@@ -0,0 +1,141 @@
+package engine
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	authPermissionAll = "*"
+)
+
+type Claims struct {
+	Rid         string   `json:"rid"`
+	Uid         string   `json:"uid"`
+	Role        string   `json:"role"`
+	Permissions []string `json:"permissions"`
+	jwt.RegisteredClaims
+}
+
+type authenticator struct {
+	secret    []byte
+	publicKey ed25519.PublicKey
+}
+
+// authMethods maps every call to the permission it requires, and the
+// positions of its rid and uid params, -1 if the call has none
+var authMethods = map[string]struct {
+	permission string
+	rid        int
+	uid        int
+}{
+	"turn":      {"turn", -1, 0},
+	"info":      {"info", -1, -1},
+	"list":      {"list", 0, -1},
+	"speakers":  {"speakers", 0, -1},
+	"stats":     {"stats", 0, 1},
+	"lastn":     {"lastn", 0, -1},
+	"slots":     {"slots", 0, 1},
+	"record":    {"record", 0, -1},
+	"mute":      {"mute", 0, -1},
+	"publish":   {"publish", 0, 1},
+	"listen":    {"listen", 0, 1},
+	"restart":   {"restart", 0, 1},
+	"end":       {"end", 0, 1},
+	"trickle":   {"trickle", 0, 1},
+	"subscribe": {"subscribe", 0, 1},
+	"answer":    {"answer", 0, 1},
+	"raise":     {"raise", 0, 1},
+	"lower":     {"raise", 0, 1},
+	"hands":     {"hands", 0, -1},
+	"promote":   {"promote", 0, -1},
+	"demote":    {"demote", 0, -1},
+	"kick":      {"kick", 0, -1},
+	"ban":       {"ban", 0, -1},
+	"whep":      {"subscribe", 0, -1},
+	"relay":     {"relay", 0, -1},
+	"unrelay":   {"relay", 0, -1},
+}
+
+func buildAuthenticator(conf *Configuration) (*authenticator, error) {
+	if conf.Auth.Secret == "" && conf.Auth.PublicKey == "" {
+		return nil, nil
+	}
+	auth := &authenticator{secret: []byte(conf.Auth.Secret)}
+	if conf.Auth.PublicKey != "" {
+		key, err := hex.DecodeString(conf.Auth.PublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid auth public key %s %v", conf.Auth.PublicKey, err)
+		}
+		auth.publicKey = key
+	}
+	return auth, nil
+}
+
+func (auth *authenticator) verify(token string) (*Claims, error) {
+	if token == "" {
+		return nil, buildError(ErrorUnauthorized, fmt.Errorf("missing token"))
+	}
+	var claims Claims
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (any, error) {
+		switch t.Method.(type) {
+		case *jwt.SigningMethodHMAC:
+			if len(auth.secret) > 0 {
+				return auth.secret, nil
+			}
+		case *jwt.SigningMethodEd25519:
+			if auth.publicKey != nil {
+				return auth.publicKey, nil
+			}
+		}
+		return nil, fmt.Errorf("unsupported signing method %s", t.Method.Alg())
+	}, jwt.WithValidMethods([]string{"HS256", "EdDSA"}), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, buildError(ErrorUnauthorized, err)
+	}
+	return &claims, nil
+}
+
+// authorize matches the claims against the params, an empty rid or uid
+// claim grants all rooms or users to trusted backend services
+func (c *Claims) authorize(method string, params []any) error {
+	m, ok := authMethods[method]
+	if !ok {
+		return buildError(ErrorForbidden, fmt.Errorf("invalid method %s", method))
+	}
+	if !slices.Contains(c.Permissions, m.permission) && !slices.Contains(c.Permissions, authPermissionAll) {
+		return buildError(ErrorForbidden, fmt.Errorf("permission %s denied", m.permission))
+	}
+	if m.rid >= 0 && c.Rid != "" && (len(params) <= m.rid || params[m.rid] != c.Rid) {
+		return buildError(ErrorForbidden, fmt.Errorf("rid not match %s", c.Rid))
+	}
+	if m.uid >= 0 && c.Uid != "" && (len(params) <= m.uid || params[m.uid] != c.Uid) {
+		return buildError(ErrorForbidden, fmt.Errorf("uid not match %s", c.Uid))
+	}
+	return nil
+}
+
+func (impl *R) authorize(token, method string, params []any) (*Claims, error) {
+	if impl.auth == nil {
+		return nil, nil
+	}
+	claims, err := impl.auth.verify(token)
+	if err != nil {
+		return nil, err
+	}
+	return claims, claims.authorize(method, params)
+}
+
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+		return token
+	}
+	return ""
+}
@@ -0,0 +1,76 @@
+package engine
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	roomBanDefaultDuration = 10 * time.Minute
+)
+
+// banning keeps a room with pending bans from eviction, otherwise the
+// banned users could join again as soon as it is collected
+func (room *pmap) banning() bool {
+	now := time.Now()
+	for _, until := range room.bans {
+		if now.Before(until) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Router) kick(rid, uid string, by *actor) (map[string]any, error) {
+	if err := by.moderate("kick", uid); err != nil {
+		return nil, err
+	}
+	room := r.engine.getRoom(rid)
+	if room == nil {
+		return nil, buildError(ErrorPeerNotFound, fmt.Errorf("peer %s not found in %s", uid, rid))
+	}
+	peer := room.PeersCopy()[uid]
+	if peer == nil || peer.cid == peerTrackClosedId {
+		return nil, buildError(ErrorPeerNotFound, fmt.Errorf("peer %s not found in %s", uid, rid))
+	}
+	cid := peer.cid
+	err := peer.CloseWithTimeout(leaveReasonKicked)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"id": uid, "track": cid}, nil
+}
+
+// ban also works before the user ever joins, so it allocates the room
+func (r *Router) ban(rid, uid string, by *actor) (map[string]any, error) {
+	if err := by.moderate("ban", uid); err != nil {
+		return nil, err
+	}
+	if err := validateId(rid); err != nil {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid rid format %s %s", rid, err.Error()))
+	}
+	duration := r.engine.Ban
+	if duration <= 0 {
+		duration = roomBanDefaultDuration
+	}
+	until := time.Now().Add(duration)
+
+	room := r.engine.GetRoom(rid)
+	room.Lock()
+	for id, t := range room.bans {
+		if time.Now().After(t) {
+			delete(room.bans, id)
+		}
+	}
+	room.bans[uid] = until
+	peer := room.m[uid]
+	room.Unlock()
+
+	if peer != nil {
+		err := peer.CloseWithTimeout(leaveReasonBanned)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return map[string]any{"id": uid, "until": until}, nil
+}
@@ -1,22 +1,52 @@
 package engine
 
-import "github.com/MixinNetwork/mixin/logger"
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-func Boot(cp, version string) {
+	"github.com/MixinNetwork/mixin/logger"
+)
+
+func Boot(cp, version string) error {
 	conf, err := Setup(cp)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	logger.SetLevel(conf.Engine.LogLevel)
 
 	engine, err := BuildEngine(conf)
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	if conf.Turn.Port > 0 {
+		server, err := ServeTURN(engine, conf)
+		if err != nil {
+			return err
+		}
+		defer server.Close()
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		sig, stop := signal.NotifyContext(ctx, syscall.SIGTERM, os.Interrupt)
+		<-sig.Done()
+		// a second signal terminates the process right away
+		stop()
+		if ctx.Err() != nil {
+			return
+		}
+		engine.Drain(time.Duration(conf.Engine.Drain) * time.Second)
+		cancel()
+	}()
+
 	go engine.Loop(version)
-	err = ServeRPC(engine, conf)
-	if err != nil {
-		panic(err)
+	if conf.Monitor.URL != "" {
+		go engine.Heartbeat(ctx, conf)
 	}
+	return ServeRPC(ctx, engine, conf)
 }
@@ -14,13 +14,41 @@ type Configuration struct {
 		LogLevel  int    `toml:"log-level"`
 		PortMin   uint16 `toml:"port-min"`
 		PortMax   uint16 `toml:"port-max"`
+		UDPPort   int    `toml:"udp-port"`
+		TCPPort   int    `toml:"tcp-port"`
+		Ban       int    `toml:"ban-duration"`
+		Drain     int    `toml:"drain-deadline"`
 	} `toml:"engine"`
 	Turn struct {
 		Host   string `toml:"host"`
 		Secret string `toml:"secret"`
+		Port   int    `toml:"port"`
 	} `toml:"turn"`
+	Recording struct {
+		Directory string `toml:"directory"`
+		Mixed     bool   `toml:"mixed"`
+	} `toml:"recording"`
+	Auth struct {
+		Secret    string `toml:"secret"`
+		PublicKey string `toml:"public-key"`
+	} `toml:"auth"`
+	Webhook struct {
+		URL     string `toml:"url"`
+		Secret  string `toml:"secret"`
+		Queue   int    `toml:"queue"`
+		Retries int    `toml:"retries"`
+	} `toml:"webhook"`
+	Relay struct {
+		Origins []string `toml:"origins"`
+	} `toml:"relay"`
+	Monitor struct {
+		URL      string `toml:"url"`
+		Endpoint string `toml:"endpoint"`
+		Secret   string `toml:"secret"`
+	} `toml:"monitor"`
 	RPC struct {
-		Port int `toml:"port"`
+		Port    int      `toml:"port"`
+		Origins []string `toml:"origins"`
 	} `toml:"rpc"`
 }
 
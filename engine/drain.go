@@ -0,0 +1,61 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/MixinNetwork/mixin/logger"
+)
+
+const (
+	engineDrainDefaultDeadline = 5 * time.Minute
+	engineDrainPollPeriod      = time.Second
+)
+
+// Drain rejects new peers, then waits for the rooms to empty until the
+// deadline, and closes the remaining peers, viewers and recordings at last
+func (engine *Engine) Drain(deadline time.Duration) {
+	if !engine.draining.CompareAndSwap(false, true) {
+		return
+	}
+	if deadline <= 0 {
+		deadline = engineDrainDefaultDeadline
+	}
+	logger.Printf("engine.Drain(%s) started\n", deadline)
+
+	timer := time.NewTimer(deadline)
+	defer timer.Stop()
+	ticker := time.NewTicker(engineDrainPollPeriod)
+	defer ticker.Stop()
+
+wait:
+	for engine.activePeers() > 0 {
+		select {
+		case <-ticker.C:
+		case <-timer.C:
+			break wait
+		}
+	}
+
+	var closed int
+	for _, room := range engine.roomsCopy() {
+		for _, p := range room.PeersCopy() {
+			if p.cid == peerTrackClosedId {
+				continue
+			}
+			_ = p.CloseWithTimeout(leaveReasonShutdown)
+			closed += 1
+		}
+		room.stopRecording()
+	}
+	viewers := engine.viewers.close()
+	logger.Printf("engine.Drain(%s) done with %d peers and %d viewers closed\n", deadline, closed, viewers)
+}
+
+func (engine *Engine) activePeers() int {
+	var active int
+	for _, room := range engine.roomsCopy() {
+		ap, al, _ := room.count()
+		active += ap + al
+	}
+	return active
+}
@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/MixinNetwork/mixin/logger"
+	"github.com/pion/ice/v4"
+	turnserver "github.com/pion/turn/v5"
 )
 
 const (
@@ -14,15 +17,19 @@ const (
 )
 
 type State struct {
-	Version     string    `json:"version"`
-	BootedAt    time.Time `json:"booted_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
-	ActivePeers int       `json:"active_peers"`
-	ClosedPeers int       `json:"closed_peers"`
-	PeakPeers   int       `json:"peak_peers"`
-	ActiveRooms int       `json:"active_rooms"`
-	ClosedRooms int       `json:"closed_rooms"`
-	PeakRooms   int       `json:"peak_rooms"`
+	Version         string    `json:"version"`
+	BootedAt        time.Time `json:"booted_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+	ActivePeers     int       `json:"active_peers"`
+	ActiveListeners int       `json:"active_listeners"`
+	ClosedPeers     int       `json:"closed_peers"`
+	PeakPeers       int       `json:"peak_peers"`
+	ActiveRooms     int       `json:"active_rooms"`
+	ClosedRooms     int       `json:"closed_rooms"`
+	PeakRooms       int       `json:"peak_rooms"`
+	EvictedPeers    int       `json:"evicted_peers"`
+	EvictedRooms    int       `json:"evicted_rooms"`
+	Draining        bool      `json:"draining"`
 }
 
 type Engine struct {
@@ -30,11 +37,25 @@ type Engine struct {
 	Interface string
 	PortMin   uint16
 	PortMax   uint16
+	Recording string
+	Mixed     bool
+	Ban       time.Duration
+	Origins   []string
 
-	peakPeers int
-	peakRooms int
-	state     *State
-	rooms     *rmap
+	peakPeers    int
+	peakRooms    int
+	evictedPeers int
+	evictedRooms int
+	state        *State
+	rooms        *rmap
+	webhook      *webhook
+	relays       *relayMap
+	viewers      *vmap
+	udpMux       ice.UDPMux
+	tcpMux       ice.TCPMux
+	turn         *turnserver.Server
+	draining     atomic.Bool
+	loopAt       atomic.Int64
 }
 
 func BuildEngine(conf *Configuration) (*Engine, error) {
@@ -47,7 +68,18 @@ func BuildEngine(conf *Configuration) (*Engine, error) {
 		Interface: conf.Engine.Interface,
 		PortMin:   conf.Engine.PortMin,
 		PortMax:   conf.Engine.PortMax,
+		Recording: conf.Recording.Directory,
+		Mixed:     conf.Recording.Mixed,
+		Ban:       time.Duration(conf.Engine.Ban) * time.Second,
+		Origins:   relayOrigins(conf.Relay.Origins),
 		rooms:     rmapAllocate(),
+		webhook:   buildWebhook(conf),
+		relays:    relayMapAllocate(),
+		viewers:   vmapAllocate(),
+	}
+	err = engine.buildICEMux(conf.Engine.UDPPort, conf.Engine.TCPPort)
+	if err != nil {
+		return nil, err
 	}
 	logger.Printf("BuildEngine(IP: %s, Interface: %s, Ports: %d-%d)\n", engine.IP, engine.Interface, engine.PortMin, engine.PortMax)
 	return engine, nil
@@ -57,6 +89,12 @@ func (engine *Engine) Loop(version string) {
 	bootedAt := time.Now()
 
 	for {
+		evictedPeers, evictedRooms := engine.collect()
+		engine.evictedPeers += evictedPeers
+		engine.evictedRooms += evictedRooms
+		metricPeersEvicted.Add(float64(evictedPeers))
+		metricRoomsEvicted.Add(float64(evictedRooms))
+
 		engine.rooms.RLock()
 		rooms := make(map[string]*pmap, len(engine.rooms.m))
 		for k, v := range engine.rooms.m {
@@ -70,20 +108,13 @@ func (engine *Engine) Loop(version string) {
 			UpdatedAt: time.Now(),
 		}
 		for _, pm := range rooms {
-			peers := pm.PeersCopy()
-			ap, cp := 0, 0
-			for _, p := range peers {
-				if p.cid == peerTrackClosedId {
-					cp += 1
-				} else {
-					ap += 1
-				}
-			}
+			ap, al, cp := pm.count()
 			state.ActivePeers += ap
+			state.ActiveListeners += al
 			state.ClosedPeers += cp
-			if ap > 0 {
+			if ap+al > 0 {
 				state.ActiveRooms += 1
-				logger.Printf("room#%s with %d active and %d closed peers", pm.id, ap, cp)
+				logger.Printf("room#%s with %d active, %d listening and %d closed peers", pm.id, ap, al, cp)
 			} else {
 				state.ClosedRooms += 1
 			}
@@ -96,7 +127,11 @@ func (engine *Engine) Loop(version string) {
 		}
 		state.PeakPeers = engine.peakPeers
 		state.PeakRooms = engine.peakRooms
+		state.EvictedPeers = engine.evictedPeers
+		state.EvictedRooms = engine.evictedRooms
+		state.Draining = engine.draining.Load()
 		engine.state = state
+		engine.loopAt.Store(state.UpdatedAt.UnixNano())
 
 		time.Sleep(engineStateLoopPeriod)
 	}
@@ -134,17 +169,47 @@ func getIPFromInterface(iname string, addr string) (string, error) {
 
 type pmap struct {
 	sync.RWMutex
-	id string
-	m  map[string]*Peer
+	id          string
+	m           map[string]*Peer
+	lastN       *lastN
+	mixer       *mixer
+	recorder    atomic.Pointer[recorder]
+	negotiating atomic.Bool
+	activeAt    atomic.Int64
+	vacant      atomic.Bool
+	stage       *stage
+	bans        map[string]time.Time
+	webhook     *webhook
+	viewers     *vmap
 }
 
-func pmapAllocate(id string) *pmap {
+func pmapAllocate(id string, hook *webhook, viewers *vmap) *pmap {
 	pm := new(pmap)
 	pm.id = id
+	pm.webhook = hook
+	pm.viewers = viewers
 	pm.m = make(map[string]*Peer)
+	pm.lastN = lastNAllocate()
+	pm.mixer = mixerAllocate(pm)
+	pm.stage = stageAllocate()
+	pm.bans = make(map[string]time.Time)
 	return pm
 }
 
+func (pm *pmap) count() (int, int, int) {
+	ap, al, cp := 0, 0, 0
+	for _, p := range pm.PeersCopy() {
+		if p.cid == peerTrackClosedId {
+			cp += 1
+		} else if p.role == peerRoleListener {
+			al += 1
+		} else {
+			ap += 1
+		}
+	}
+	return ap, al, cp
+}
+
 type rmap struct {
 	sync.RWMutex
 	m map[string]*pmap
@@ -156,6 +221,18 @@ func rmapAllocate() *rmap {
 	return rm
 }
 
+func (engine *Engine) roomsCopy() []*pmap {
+	rm := engine.rooms
+	rm.RLock()
+	defer rm.RUnlock()
+
+	rooms := make([]*pmap, 0, len(rm.m))
+	for _, pm := range rm.m {
+		rooms = append(rooms, pm)
+	}
+	return rooms
+}
+
 func (engine *Engine) getRoom(rid string) *pmap {
 	rm := engine.rooms
 	rm.RLock()
@@ -164,21 +241,50 @@ func (engine *Engine) getRoom(rid string) *pmap {
 	return rm.m[rid]
 }
 
+// GetRoom refreshes the room activity while holding the rooms lock, so the
+// collector never evicts a room handed out to a writer
 func (engine *Engine) GetRoom(rid string) *pmap {
-	pm := engine.getRoom(rid)
+	rm := engine.rooms
+	rm.RLock()
+	pm := rm.m[rid]
+	if pm != nil {
+		pm.activeAt.Store(time.Now().UnixNano())
+	}
+	rm.RUnlock()
 	if pm != nil {
 		return pm
 	}
 
-	rm := engine.rooms
 	rm.Lock()
 	defer rm.Unlock()
 	if rm.m[rid] == nil {
-		rm.m[rid] = pmapAllocate(rid)
+		rm.m[rid] = pmapAllocate(rid, engine.webhook, engine.viewers)
 	}
+	rm.m[rid].activeAt.Store(time.Now().UnixNano())
 	return rm.m[rid]
 }
 
+func (engine *Engine) GetPeer(rid, uid, cid string) (*pmap, *Peer, error) {
+	room := engine.getRoom(rid)
+	if room == nil {
+		return nil, nil, buildError(ErrorPeerNotFound, fmt.Errorf("peer %s not found in %s", uid, rid))
+	}
+	peer, err := room.GetPeer(uid, cid)
+	return room, peer, err
+}
+
+func (room *pmap) empty() bool {
+	room.RLock()
+	defer room.RUnlock()
+
+	for _, p := range room.m {
+		if p.cid != peerTrackClosedId {
+			return false
+		}
+	}
+	return true
+}
+
 func (room *pmap) PeersCopy() map[string]*Peer {
 	room.RLock()
 	defer room.RUnlock()
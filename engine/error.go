@@ -13,6 +13,8 @@ const (
 	ErrorPeerNotFound            = 5002001
 	ErrorPeerClosed              = 5002002
 	ErrorTrackNotFound           = 5002003
+	ErrorRecordingDisabled       = 5002004
+	ErrorRelayNotFound           = 5002005
 	ErrorServerNewPeerConnection = 5003000
 	ErrorServerCreateOffer       = 5003001
 	ErrorServerSetLocalOffer     = 5003002
@@ -22,7 +24,15 @@ const (
 	ErrorServerCreateAnswer      = 5003006
 	ErrorServerSetLocalAnswer    = 5003007
 	ErrorServerSetRemoteAnswer   = 5003008
+	ErrorServerRecording         = 5003009
+	ErrorServerDraining          = 5003010
 	ErrorServerTimeout           = 5003999
+	ErrorUnauthorized            = 5004000
+	ErrorForbidden               = 5004001
+	ErrorModeratorRequired       = 5004002
+	ErrorListenerUnmute          = 5004003
+	ErrorPeerBanned              = 5004004
+	ErrorRelayForbidden          = 5004005
 )
 
 type Error struct {
@@ -41,6 +51,16 @@ func buildError(code int, err error) error {
 	if code >= ErrorServerNewPeerConnection && code <= ErrorServerTimeout {
 		status = http.StatusInternalServerError
 	}
+	if code == ErrorServerDraining {
+		status = http.StatusServiceUnavailable
+	}
+	if code == ErrorUnauthorized {
+		status = http.StatusUnauthorized
+	}
+	if code >= ErrorForbidden && code <= ErrorRelayForbidden {
+		status = http.StatusForbidden
+	}
+	observeError(code)
 	return Error{
 		Status:      status,
 		Code:        code,
@@ -0,0 +1,86 @@
+package engine
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	healthLoopTimeout = 3 * engineStateLoopPeriod
+	healthPortProbes  = 8
+)
+
+// checkLoop fails when the engine loop is stuck, e.g. on a room lock
+func (engine *Engine) checkLoop() error {
+	at := engine.loopAt.Load()
+	if at == 0 {
+		return fmt.Errorf("loop not started")
+	}
+	if age := time.Since(time.Unix(0, at)); age > healthLoopTimeout {
+		return fmt.Errorf("loop stale for %s", age.Round(time.Second))
+	}
+	return nil
+}
+
+// checkPorts binds a few random ports of the range, it fails only when
+// the range looks exhausted by the peer connections or other processes
+func (engine *Engine) checkPorts() error {
+	if engine.udpMux != nil {
+		return nil
+	}
+	min, max := int(engine.PortMin), int(engine.PortMax)
+	if min == 0 || max == 0 || max < min {
+		min, max = 0, 0
+	}
+	for range healthPortProbes {
+		port := min
+		if max > min {
+			port += rand.IntN(max - min + 1)
+		}
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+		if err == nil {
+			return conn.Close()
+		}
+	}
+	return fmt.Errorf("no free udp port in %d-%d", min, max)
+}
+
+func (engine *Engine) checkDrain() error {
+	if engine.draining.Load() {
+		return fmt.Errorf("draining")
+	}
+	return nil
+}
+
+func renderHealth(w http.ResponseWriter, checks map[string]error) {
+	status, results := http.StatusOK, make(map[string]string, len(checks))
+	for name, err := range checks {
+		results[name] = "ok"
+		if err != nil {
+			status, results[name] = http.StatusServiceUnavailable, err.Error()
+		}
+	}
+	renderJSON(w, status, map[string]any{"status": http.StatusText(status), "checks": results})
+}
+
+// healthz is the liveness probe, a draining engine is still alive and
+// must not be restarted before its rooms empty
+func (impl *R) healthz(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	renderHealth(w, map[string]error{
+		"rpc":  nil,
+		"loop": impl.router.engine.checkLoop(),
+	})
+}
+
+func (impl *R) readyz(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	engine := impl.router.engine
+	renderHealth(w, map[string]error{
+		"rpc":   nil,
+		"loop":  engine.checkLoop(),
+		"ports": engine.checkPorts(),
+		"drain": engine.checkDrain(),
+	})
+}
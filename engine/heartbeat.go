@@ -0,0 +1,97 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/gofrs/uuid/v5"
+)
+
+const (
+	heartbeatPeriod = 10 * time.Second
+)
+
+// Heartbeat reports the live state and active rooms of the engine to the
+// monitor, which routes new rooms to the least loaded engine
+func (engine *Engine) Heartbeat(ctx context.Context, conf *Configuration) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	ticker := time.NewTicker(heartbeatPeriod)
+	defer ticker.Stop()
+
+	for {
+		err := engine.heartbeat(client, conf)
+		if err != nil {
+			logger.Printf("engine.Heartbeat(%s) => %v\n", conf.Monitor.URL, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (engine *Engine) heartbeat(client *http.Client, conf *Configuration) error {
+	state, rooms := engine.liveState()
+	body, _ := json.Marshal(map[string]any{
+		"id":     uuid.Must(uuid.NewV4()).String(),
+		"method": "heartbeat",
+		"params": []any{conf.Monitor.Endpoint, state, rooms},
+	})
+	req, err := http.NewRequest("POST", conf.Monitor.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if conf.Monitor.Secret != "" {
+		req.Header.Set("Authorization", "Bearer "+conf.Monitor.Secret)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		Error *Error `json:"error"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return fmt.Errorf("status: %d %v", resp.StatusCode, err)
+	}
+	if res.Error != nil {
+		return res.Error
+	}
+	return nil
+}
+
+// liveState refreshes the counters of the last loop state, which may be
+// a whole loop period old
+func (engine *Engine) liveState() (State, []string) {
+	var state State
+	engine.rooms.RLock()
+	if engine.state != nil {
+		state = *engine.state
+	}
+	engine.rooms.RUnlock()
+
+	rooms := []string{}
+	state.ActivePeers, state.ActiveListeners, state.ActiveRooms = 0, 0, 0
+	for _, pm := range engine.roomsCopy() {
+		ap, al, _ := pm.count()
+		state.ActivePeers += ap
+		state.ActiveListeners += al
+		if ap+al > 0 {
+			state.ActiveRooms += 1
+			rooms = append(rooms, pm.id)
+		}
+	}
+	state.UpdatedAt = time.Now()
+	state.Draining = engine.draining.Load()
+	return state, rooms
+}
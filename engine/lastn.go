@@ -0,0 +1,317 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/gofrs/uuid/v5"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	lastNMaximum        = 32
+	lastNSelectPeriod   = 500 * time.Millisecond
+	lastNStickyBonus    = 8
+	lastNFrameTimestamp = 960
+)
+
+type Slot struct {
+	sync.Mutex
+	id        string
+	local     *webrtc.TrackLocalStaticRTP
+	sender    *webrtc.RTPSender
+	uid       string
+	source    string
+	pending   bool
+	written   bool
+	writtenAt time.Time
+	lastSeq   uint16
+	lastTs    uint32
+	seqOffset uint16
+	tsOffset  uint32
+}
+
+type lastNSubscriber struct {
+	uid   string
+	slots []*Slot
+}
+
+type lastN struct {
+	sync.RWMutex
+	n       int
+	running bool
+	subs    map[string]*lastNSubscriber
+	routes  map[string][]*Slot
+}
+
+func lastNAllocate() *lastN {
+	return &lastN{
+		subs:   make(map[string]*lastNSubscriber),
+		routes: make(map[string][]*Slot),
+	}
+}
+
+func (ln *lastN) size() int {
+	ln.RLock()
+	defer ln.RUnlock()
+
+	return ln.n
+}
+
+func (room *pmap) setLastN(n int) error {
+	if n < 0 || n > lastNMaximum {
+		return buildError(ErrorInvalidParams, fmt.Errorf("invalid last n %d", n))
+	}
+
+	ln := room.lastN
+	ln.Lock()
+	defer ln.Unlock()
+
+	ln.n = n
+	if n > 0 && !ln.running {
+		ln.running = true
+		go room.loopLastN()
+	}
+	return nil
+}
+
+func (room *pmap) loopLastN() {
+	ln := room.lastN
+	for {
+		time.Sleep(lastNSelectPeriod)
+		ln.Lock()
+		if ln.n == 0 {
+			ln.running = false
+			ln.routes = make(map[string][]*Slot)
+			ln.Unlock()
+			return
+		}
+		ln.Unlock()
+		room.selectLastN()
+	}
+}
+
+func (room *pmap) selectLastN() {
+	type candidate struct {
+		uid   string
+		track string
+		level float64
+	}
+	var candidates []candidate
+	active := make(map[string]bool)
+	for _, p := range room.PeersCopy() {
+		if p.cid == peerTrackClosedId {
+			continue
+		}
+		active[p.cid] = true
+		if p.role == peerRoleListener {
+			continue
+		}
+		for _, t := range p.tracksCopy() {
+			if t.kind != webrtc.RTPCodecTypeAudio {
+				continue
+			}
+			candidates = append(candidates, candidate{uid: p.uid, track: t.id, level: t.currentLevel()})
+		}
+	}
+
+	ln := room.lastN
+	ln.Lock()
+	defer ln.Unlock()
+
+	routes := make(map[string][]*Slot)
+	for cid, sub := range ln.subs {
+		if !active[cid] {
+			delete(ln.subs, cid)
+			continue
+		}
+		assigned := make(map[string]*Slot)
+		for _, s := range sub.slots {
+			if s.source != "" {
+				assigned[s.source] = s
+			}
+		}
+
+		var ranking []candidate
+		for _, c := range candidates {
+			if c.uid == sub.uid {
+				continue
+			}
+			if assigned[c.track] != nil {
+				c.level += lastNStickyBonus
+			}
+			ranking = append(ranking, c)
+		}
+		sort.SliceStable(ranking, func(i, j int) bool {
+			return ranking[i].level > ranking[j].level
+		})
+		if len(ranking) > len(sub.slots) {
+			ranking = ranking[:len(sub.slots)]
+		}
+
+		selected := make(map[string]bool)
+		for _, c := range ranking {
+			selected[c.track] = true
+		}
+		var free []*Slot
+		for _, s := range sub.slots {
+			if !selected[s.source] {
+				free = append(free, s)
+			}
+		}
+		for _, c := range ranking {
+			s := assigned[c.track]
+			if s == nil {
+				s, free = free[0], free[1:]
+				s.assign(c.uid, c.track)
+				logger.Verbosef("lastN(%s, %s) slot %s => %s:%s\n", room.id, cid, s.id, c.uid, c.track)
+			}
+			routes[c.track] = append(routes[c.track], s)
+		}
+		for _, s := range free {
+			s.assign("", "")
+		}
+	}
+	ln.routes = routes
+}
+
+func (room *pmap) forwardLastN(track *Track, pkt *rtp.Packet) {
+	ln := room.lastN
+	ln.RLock()
+	slots := ln.routes[track.id]
+	ln.RUnlock()
+
+	for _, s := range slots {
+		err := s.write(track.id, pkt)
+		if err != nil {
+			logger.Verbosef("lastN(%s) slot %s write %v\n", room.id, s.id, err)
+		}
+	}
+}
+
+func (room *pmap) slotsOf(cid string) []map[string]any {
+	ln := room.lastN
+	ln.RLock()
+	defer ln.RUnlock()
+
+	list := make([]map[string]any, 0)
+	sub := ln.subs[cid]
+	if sub == nil {
+		return list
+	}
+	for _, s := range sub.slots {
+		s.Lock()
+		list = append(list, map[string]any{
+			"track":  s.id,
+			"id":     s.uid,
+			"source": s.source,
+		})
+		s.Unlock()
+	}
+	return list
+}
+
+func (sub *Peer) connectSlots(ln *lastN, n int) (bool, error) {
+	ln.Lock()
+	defer ln.Unlock()
+
+	var renegotiate bool
+	err := lockRunWithTimeout(func() error {
+		state := ln.subs[sub.cid]
+		if state == nil {
+			state = &lastNSubscriber{uid: sub.uid}
+			ln.subs[sub.cid] = state
+		}
+		for len(state.slots) > n {
+			s := state.slots[len(state.slots)-1]
+			err := sub.pc.RemoveTrack(s.sender)
+			if err != nil {
+				return fmt.Errorf("pc.RemoveTrack(%s, %s) => %v", sub.id(), s.id, err)
+			}
+			state.slots = state.slots[:len(state.slots)-1]
+			renegotiate = true
+		}
+		for len(state.slots) < n {
+			s, err := buildSlot(len(state.slots))
+			if err != nil {
+				return buildError(ErrorServerNewTrack, err)
+			}
+			sender, err := sub.pc.AddTrack(s.local)
+			logger.Printf("pc.AddTrack(%s, %s) => %v %v", sub.id(), s.id, sender, err)
+			if err != nil {
+				return fmt.Errorf("pc.AddTrack(%s, %s) => %v", sub.id(), s.id, err)
+			}
+			s.sender = sender
+			state.slots = append(state.slots, s)
+			renegotiate = true
+		}
+		if len(state.slots) == 0 {
+			delete(ln.subs, sub.cid)
+		}
+		return nil
+	}, peerTrackReadTimeout)
+	return renegotiate, err
+}
+
+func buildSlot(index int) (*Slot, error) {
+	id := uuid.Must(uuid.NewV4()).String()
+	codec := webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeOpus,
+		ClockRate:   48000,
+		Channels:    2,
+		SDPFmtpLine: "minptime=10;useinbandfec=1",
+	}
+	lt, err := webrtc.NewTrackLocalStaticRTP(codec, id, fmt.Sprintf("lastn-%d", index))
+	if err != nil {
+		return nil, err
+	}
+	return &Slot{id: id, local: lt}, nil
+}
+
+func (s *Slot) assign(uid, source string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.source == source {
+		return
+	}
+	s.uid = uid
+	s.source = source
+	s.pending = true
+}
+
+// write continues the slot sequence and timestamp space across source
+// switches, the SSRC is rewritten by the local track for each binding
+func (s *Slot) write(source string, pkt *rtp.Packet) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.source != source {
+		return nil
+	}
+	out := *pkt
+	if s.pending {
+		s.pending = false
+		s.seqOffset, s.tsOffset = 0, 0
+		if s.written {
+			gap := uint32(time.Since(s.writtenAt).Seconds() * opusSampleRate)
+			gap = max(gap/lastNFrameTimestamp, 1) * lastNFrameTimestamp
+			s.seqOffset = s.lastSeq + 1 - pkt.SequenceNumber
+			s.tsOffset = s.lastTs + gap - pkt.Timestamp
+		}
+		out.Marker = true
+	}
+	out.SequenceNumber = pkt.SequenceNumber + s.seqOffset
+	out.Timestamp = pkt.Timestamp + s.tsOffset
+	if !s.written || int16(out.SequenceNumber-s.lastSeq) > 0 {
+		s.lastSeq = out.SequenceNumber
+		s.lastTs = out.Timestamp
+		s.writtenAt = time.Now()
+		s.written = true
+	}
+	return s.local.WriteRTP(&out)
+}
@@ -0,0 +1,103 @@
+package engine
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	audioLevelExtensionURI      = "urn:ietf:params:rtp-hdrext:ssrc-audio-level"
+	audioLevelSmoothing         = 0.15
+	audioLevelStaleTimeout      = time.Second
+	audioLevelSpeakingThreshold = 72
+)
+
+func audioLevelExtensionId(receiver *webrtc.RTPReceiver) uint8 {
+	for _, ext := range receiver.GetParameters().HeaderExtensions {
+		if ext.URI == audioLevelExtensionURI {
+			return uint8(ext.ID)
+		}
+	}
+	return 0
+}
+
+// updateLevel smooths the RFC 6464 level of the packet into the track,
+// the level is inverted so that 0 is silence and 127 is the loudest
+func (t *Track) updateLevel(pkt *rtp.Packet, mute bool) {
+	if t.levelId == 0 {
+		return
+	}
+	ext := pkt.GetExtension(t.levelId)
+	if ext == nil {
+		return
+	}
+	var al rtp.AudioLevelExtension
+	if al.Unmarshal(ext) != nil {
+		return
+	}
+
+	loudness := float64(127 - al.Level)
+	if mute {
+		loudness = 0
+		silent, _ := rtp.AudioLevelExtension{Level: 127}.Marshal()
+		_ = pkt.SetExtension(t.levelId, silent)
+	}
+	old := math.Float64frombits(t.level.Load())
+	t.level.Store(math.Float64bits(old + (loudness-old)*audioLevelSmoothing))
+	t.levelAt.Store(time.Now().UnixNano())
+}
+
+func (t *Track) currentLevel() float64 {
+	if time.Since(time.Unix(0, t.levelAt.Load())) > audioLevelStaleTimeout {
+		return 0
+	}
+	return math.Float64frombits(t.level.Load())
+}
+
+func (p *Peer) level() int {
+	var level float64
+	for _, t := range p.tracksCopy() {
+		if t.kind == webrtc.RTPCodecTypeAudio {
+			level = max(level, t.currentLevel())
+		}
+	}
+	return int(math.Round(level))
+}
+
+func (room *pmap) speakers() []map[string]any {
+	type speaker struct {
+		uid   string
+		cid   string
+		level int
+	}
+	var ranking []speaker
+	for _, p := range room.PeersCopy() {
+		if p.cid == peerTrackClosedId || p.role == peerRoleListener {
+			continue
+		}
+		ranking = append(ranking, speaker{uid: p.uid, cid: p.cid, level: p.level()})
+	}
+	sort.SliceStable(ranking, func(i, j int) bool {
+		if ranking[i].level == ranking[j].level {
+			return ranking[i].uid < ranking[j].uid
+		}
+		return ranking[i].level > ranking[j].level
+	})
+
+	list := make([]map[string]any, 0, len(ranking))
+	for i, s := range ranking {
+		speaking := s.level >= audioLevelSpeakingThreshold
+		list = append(list, map[string]any{
+			"id":       s.uid,
+			"track":    s.cid,
+			"level":    s.level,
+			"speaking": speaking,
+			"dominant": i == 0 && speaking,
+		})
+	}
+	return list
+}
@@ -0,0 +1,68 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/MixinNetwork/mixin/logger"
+)
+
+const (
+	peerEvictionGrace = 30 * time.Second
+	roomEvictionGrace = 60 * time.Second
+)
+
+func (engine *Engine) collect() (int, int) {
+	rooms := engine.roomsCopy()
+	var peers int
+	for _, room := range rooms {
+		peers += room.evictPeers()
+	}
+
+	rm := engine.rooms
+	rm.Lock()
+	defer rm.Unlock()
+
+	var evicted int
+	for _, room := range rooms {
+		if !room.idle() {
+			continue
+		}
+		delete(rm.m, room.id)
+		_ = room.setLastN(0)
+		evicted += 1
+		logger.Printf("engine.collect() evict room#%s\n", room.id)
+	}
+	return peers, evicted
+}
+
+func (room *pmap) evictPeers() int {
+	room.Lock()
+	defer room.Unlock()
+
+	var evicted int
+	for uid, p := range room.m {
+		if p.cid != peerTrackClosedId || time.Since(p.closedAt) < peerEvictionGrace {
+			continue
+		}
+		delete(room.m, uid)
+		evicted += 1
+	}
+	return evicted
+}
+
+// idle is checked under the rooms lock, a room still locked by a writer
+// is kept until the next collection
+func (room *pmap) idle() bool {
+	if time.Since(time.Unix(0, room.activeAt.Load())) < roomEvictionGrace {
+		return false
+	}
+	if room.recorder.Load() != nil {
+		return false
+	}
+	if !room.TryRLock() {
+		return false
+	}
+	defer room.RUnlock()
+
+	return len(room.m) == 0 && !room.banning()
+}
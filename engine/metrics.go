@@ -0,0 +1,191 @@
+package engine
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace = "kraken"
+)
+
+var (
+	metricPeersLeft = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "peers_left_total",
+		Help:      "Peers closed, by leave reason.",
+	}, []string{"reason"})
+	metricPeersEvicted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "peers_evicted_total",
+		Help:      "Closed peers removed from their rooms.",
+	})
+	metricRoomsEvicted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rooms_evicted_total",
+		Help:      "Idle rooms removed from the engine.",
+	})
+	metricRPCDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpc_duration_seconds",
+		Help:      "RPC call latency, by method and result.",
+		Buckets:   []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20},
+	}, []string{"method", "result"})
+	metricErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "errors_total",
+		Help:      "Errors built by the engine, by error code.",
+	}, []string{"code"})
+	metricForwardedPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "forwarded_packets_total",
+		Help:      "RTP packets forwarded from publishers, by media kind.",
+	}, []string{"kind"})
+	metricForwardedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "forwarded_bytes_total",
+		Help:      "RTP payload bytes forwarded from publishers, by media kind.",
+	}, []string{"kind"})
+	metricFractionLost = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "rtcp_fraction_lost",
+		Help:      "Packet loss fraction in the receiver reports of subscribers.",
+		Buckets:   []float64{0, 0.01, 0.02, 0.05, 0.1, 0.2, 0.5, 1},
+	}, []string{"kind"})
+	metricJitter = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "rtcp_jitter_seconds",
+		Help:      "Interarrival jitter in the receiver reports of subscribers.",
+		Buckets:   []float64{0.001, 0.005, 0.01, 0.02, 0.05, 0.1, 0.2, 0.5},
+	}, []string{"kind"})
+	metricICEStates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ice_state_transitions_total",
+		Help:      "ICE connection state transitions of peers, by new state.",
+	}, []string{"state"})
+	metricWebhookFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "webhook_failures_total",
+		Help:      "Failed webhook deliveries, retried or dropped.",
+	}, []string{"result"})
+
+	metricAudioPackets = metricForwardedPackets.WithLabelValues(webrtc.RTPCodecTypeAudio.String())
+	metricAudioBytes   = metricForwardedBytes.WithLabelValues(webrtc.RTPCodecTypeAudio.String())
+	metricVideoPackets = metricForwardedPackets.WithLabelValues(webrtc.RTPCodecTypeVideo.String())
+	metricVideoBytes   = metricForwardedBytes.WithLabelValues(webrtc.RTPCodecTypeVideo.String())
+)
+
+var (
+	metricPeersDesc = prometheus.NewDesc(metricsNamespace+"_peers",
+		"Peers in the engine, by state.", []string{"state"}, nil)
+	metricRoomsDesc = prometheus.NewDesc(metricsNamespace+"_rooms",
+		"Rooms in the engine, by state.", []string{"state"}, nil)
+	metricTURNAllocationsDesc = prometheus.NewDesc(metricsNamespace+"_turn_allocations",
+		"Allocations of the embedded TURN server.", nil, nil)
+)
+
+// engineCollector counts the peers and rooms on every scrape, instead of
+// waiting for the state snapshot of the engine loop
+type engineCollector struct {
+	engine *Engine
+}
+
+func (c *engineCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- metricPeersDesc
+	ch <- metricRoomsDesc
+	ch <- metricTURNAllocationsDesc
+}
+
+func (c *engineCollector) Collect(ch chan<- prometheus.Metric) {
+	rooms := c.engine.roomsCopy()
+	var active, listening, closed, activeRooms int
+	for _, pm := range rooms {
+		ap, al, cp := pm.count()
+		active, listening, closed = active+ap, listening+al, closed+cp
+		if ap+al > 0 {
+			activeRooms += 1
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(metricPeersDesc, prometheus.GaugeValue, float64(active), "active")
+	ch <- prometheus.MustNewConstMetric(metricPeersDesc, prometheus.GaugeValue, float64(listening), "listening")
+	ch <- prometheus.MustNewConstMetric(metricPeersDesc, prometheus.GaugeValue, float64(closed), "closed")
+	ch <- prometheus.MustNewConstMetric(metricRoomsDesc, prometheus.GaugeValue, float64(activeRooms), "active")
+	ch <- prometheus.MustNewConstMetric(metricRoomsDesc, prometheus.GaugeValue, float64(len(rooms)-activeRooms), "closed")
+	if c.engine.turn != nil {
+		ch <- prometheus.MustNewConstMetric(metricTURNAllocationsDesc, prometheus.GaugeValue, float64(c.engine.turn.AllocationCount()))
+	}
+}
+
+func metricsHandler(engine *Engine) http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		&engineCollector{engine: engine},
+		metricPeersLeft,
+		metricPeersEvicted,
+		metricRoomsEvicted,
+		metricRPCDuration,
+		metricErrors,
+		metricForwardedPackets,
+		metricForwardedBytes,
+		metricFractionLost,
+		metricJitter,
+		metricICEStates,
+		metricWebhookFailures,
+	)
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// observeRPC labels unknown methods together, so a client can not blow
+// up the label cardinality with random method names
+func observeRPC(method string, startAt time.Time, err error) {
+	if _, ok := authMethods[method]; !ok && method != "root" {
+		method = "unknown"
+	}
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	metricRPCDuration.WithLabelValues(method, result).Observe(time.Since(startAt).Seconds())
+}
+
+func observeError(code int) {
+	metricErrors.WithLabelValues(strconv.Itoa(code)).Inc()
+}
+
+func observeForward(track *Track, pkt *rtp.Packet) {
+	if track.kind == webrtc.RTPCodecTypeVideo {
+		metricVideoPackets.Inc()
+		metricVideoBytes.Add(float64(len(pkt.Payload)))
+	} else {
+		metricAudioPackets.Inc()
+		metricAudioBytes.Add(float64(len(pkt.Payload)))
+	}
+}
+
+// observeReceiverReport matches the reports against the SSRC of the sender,
+// which differs from the publisher SSRC for every subscriber
+func observeReceiverReport(track *Track, sender *webrtc.RTPSender, rr *rtcp.ReceiverReport) {
+	encodings := sender.GetParameters().Encodings
+	clockRate := float64(track.local.Codec().ClockRate)
+	if len(encodings) == 0 || clockRate == 0 {
+		return
+	}
+	kind := track.kind.String()
+	for _, r := range rr.Reports {
+		if r.SSRC != uint32(encodings[0].SSRC) {
+			continue
+		}
+		metricFractionLost.WithLabelValues(kind).Observe(float64(r.FractionLost) / 256)
+		metricJitter.WithLabelValues(kind).Observe(float64(r.Jitter) / clockRate)
+	}
+}
@@ -0,0 +1,376 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/gofrs/uuid/v5"
+	opusenc "github.com/lostromb/concentus/go/opus"
+	"github.com/pion/opus"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+const (
+	mixerSampleRate     = 16000
+	mixerFrameSamples   = mixerSampleRate / 50
+	mixerFramePeriod    = 20 * time.Millisecond
+	mixerJitterFrames   = 3
+	mixerMaximumGap     = opusSampleRate / 5
+	mixerSourceTimeout  = 2 * time.Second
+	mixerCleanupPeriod  = 50
+	mixerDecodeCapacity = mixerSampleRate * 120 / 1000
+	mixerOpusBitrate    = 32000
+	mixerOpusPacketSize = 1275
+)
+
+// mixerSource is only decoded by the forwarding goroutine of its track, and
+// the lock just guards the buffered PCM, so neither a decode nor the mixer
+// tick blocks the other publishers of the room
+type mixerSource struct {
+	sync.Mutex
+	uid      string
+	decoder  opus.Decoder
+	pcm      []int16
+	started  bool
+	primed   bool
+	nextTs   uint32
+	updateAt time.Time
+}
+
+// mixerOutput re-encodes the mix to Opus with its own encoder, which is
+// only used by the tick goroutine
+type mixerOutput struct {
+	uid     string
+	local   *webrtc.TrackLocalStaticSample
+	sender  *webrtc.RTPSender
+	encoder *opusenc.OpusEncoder
+}
+
+type mixerFrame struct {
+	cid string
+	out *mixerOutput
+	pcm []int16
+}
+
+type mixerSink struct {
+	wav     *wavWriter
+	startAt time.Time
+	frames  int64
+}
+
+type mixer struct {
+	sync.Mutex
+	room    *pmap
+	running bool
+	sources map[string]*mixerSource
+	outputs map[string]*mixerOutput
+	sink    *mixerSink
+}
+
+func mixerAllocate(room *pmap) *mixer {
+	return &mixer{
+		room:    room,
+		sources: make(map[string]*mixerSource),
+		outputs: make(map[string]*mixerOutput),
+	}
+}
+
+func (m *mixer) write(uid string, track *Track, pkt *rtp.Packet) {
+	m.Lock()
+	if !m.running {
+		m.Unlock()
+		return
+	}
+	src := m.sources[track.id]
+	if src == nil {
+		decoder, err := opus.NewDecoderWithOutput(mixerSampleRate, 1)
+		if err != nil {
+			panic(err)
+		}
+		src = &mixerSource{uid: uid, decoder: decoder}
+		m.sources[track.id] = src
+	}
+	m.Unlock()
+
+	src.decode(pkt)
+}
+
+func (src *mixerSource) decode(pkt *rtp.Packet) {
+	samples := opusPacketSamples(pkt.Payload)
+	if samples == 0 {
+		return
+	}
+	var gap int32
+	if src.started {
+		gap = int32(pkt.Timestamp - src.nextTs)
+		if gap < 0 {
+			return
+		}
+		gap = min(gap, mixerMaximumGap)
+	}
+	src.started = true
+	src.nextTs = pkt.Timestamp + uint32(samples)
+
+	pcm := make([]int16, mixerDecodeCapacity)
+	n, err := src.decoder.DecodeToInt16(pkt.Payload, pcm)
+	if err != nil {
+		logger.Verbosef("mixer.decode(%s, %d) => %v\n", src.uid, pkt.SequenceNumber, err)
+		n = samples * mixerSampleRate / opusSampleRate
+		clear(pcm[:n])
+	}
+
+	src.Lock()
+	defer src.Unlock()
+
+	src.updateAt = time.Now()
+	if gap > 0 {
+		src.pcm = append(src.pcm, make([]int16, int(gap)*mixerSampleRate/opusSampleRate)...)
+	}
+	src.pcm = append(src.pcm, pcm[:n]...)
+	if len(src.pcm) > mixerFrameSamples*mixerJitterFrames*2 {
+		src.pcm = src.pcm[len(src.pcm)-mixerFrameSamples*mixerJitterFrames:]
+	}
+}
+
+func (src *mixerSource) frame() []int16 {
+	src.Lock()
+	defer src.Unlock()
+
+	if !src.primed {
+		if len(src.pcm) < mixerFrameSamples*mixerJitterFrames {
+			return nil
+		}
+		src.primed = true
+	}
+	frame := make([]int16, mixerFrameSamples)
+	n := copy(frame, src.pcm)
+	src.pcm = src.pcm[n:]
+	return frame
+}
+
+func (m *mixer) loop() {
+	ticker := time.NewTicker(mixerFramePeriod)
+	defer ticker.Stop()
+
+	for i := 1; ; i++ {
+		<-ticker.C
+		if i%mixerCleanupPeriod == 0 {
+			m.cleanup()
+		}
+		if !m.tick() {
+			return
+		}
+	}
+}
+
+// tick encodes the frames of the subscribers after the mixer lock is
+// released, so the encoders never block the forwarding of publishers
+func (m *mixer) tick() bool {
+	frames, ok := m.mix()
+	for _, f := range frames {
+		err := f.out.write(f.pcm)
+		if err != nil {
+			logger.Verbosef("mixer.tick(%s, %s) => %v\n", m.room.id, f.cid, err)
+		}
+	}
+	return ok
+}
+
+func (m *mixer) mix() ([]*mixerFrame, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	if len(m.outputs) == 0 && m.sink == nil {
+		m.running = false
+		m.sources = make(map[string]*mixerSource)
+		return nil, false
+	}
+
+	total := make([]int32, mixerFrameSamples)
+	own := make(map[string][]int32)
+	for _, src := range m.sources {
+		frame := src.frame()
+		if frame == nil {
+			continue
+		}
+		mine := own[src.uid]
+		if mine == nil {
+			mine = make([]int32, mixerFrameSamples)
+			own[src.uid] = mine
+		}
+		for i, s := range frame {
+			total[i] += int32(s)
+			mine[i] += int32(s)
+		}
+	}
+
+	if m.sink != nil {
+		err := m.sink.write(total)
+		if err != nil {
+			logger.Verbosef("mixer.sink(%s) => %v\n", m.room.id, err)
+		}
+	}
+
+	frames := make([]*mixerFrame, 0, len(m.outputs))
+	for cid, out := range m.outputs {
+		mine := own[out.uid]
+		pcm := make([]int16, mixerFrameSamples)
+		for i, s := range total {
+			if mine != nil {
+				s -= mine[i]
+			}
+			pcm[i] = clampInt16(s)
+		}
+		frames = append(frames, &mixerFrame{cid: cid, out: out, pcm: pcm})
+	}
+	return frames, true
+}
+
+func newMixerOutput(uid string, local *webrtc.TrackLocalStaticSample) (*mixerOutput, error) {
+	encoder, err := opusenc.NewOpusEncoder(mixerSampleRate, 1, opusenc.OPUS_APPLICATION_VOIP)
+	if err != nil {
+		return nil, err
+	}
+	encoder.SetBitrate(mixerOpusBitrate)
+	return &mixerOutput{uid: uid, local: local, encoder: encoder}, nil
+}
+
+func (out *mixerOutput) encode(pcm []int16) ([]byte, error) {
+	packet := make([]byte, mixerOpusPacketSize)
+	n, err := out.encoder.Encode(pcm, 0, len(pcm), packet, 0, len(packet))
+	if err != nil {
+		return nil, err
+	}
+	return packet[:n], nil
+}
+
+func (out *mixerOutput) write(pcm []int16) error {
+	packet, err := out.encode(pcm)
+	if err != nil {
+		return err
+	}
+	return out.local.WriteSample(media.Sample{Data: packet, Duration: mixerFramePeriod})
+}
+
+func (m *mixer) cleanup() {
+	active := make(map[string]bool)
+	for _, p := range m.room.PeersCopy() {
+		if p.cid != peerTrackClosedId {
+			active[p.cid] = true
+		}
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	for cid := range m.outputs {
+		if !active[cid] {
+			delete(m.outputs, cid)
+		}
+	}
+	for id, src := range m.sources {
+		if src.idle() {
+			delete(m.sources, id)
+		}
+	}
+}
+
+func (src *mixerSource) idle() bool {
+	src.Lock()
+	defer src.Unlock()
+
+	return time.Since(src.updateAt) > mixerSourceTimeout
+}
+
+func (m *mixer) attach(wav *wavWriter) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.sink = &mixerSink{wav: wav, startAt: time.Now()}
+	if !m.running {
+		m.running = true
+		go m.loop()
+	}
+}
+
+func (m *mixer) detach() *wavWriter {
+	m.Lock()
+	defer m.Unlock()
+
+	sink := m.sink
+	if sink == nil {
+		return nil
+	}
+	m.sink = nil
+	return sink.wav
+}
+
+// write keeps the file aligned to the wall clock, the frames missed
+// by a late ticker are filled with silence
+func (sink *mixerSink) write(total []int32) error {
+	expected := int64(time.Since(sink.startAt) / mixerFramePeriod)
+	frame := make([]int16, mixerFrameSamples)
+	for i, s := range total {
+		frame[i] = clampInt16(s)
+	}
+	for sink.frames < expected {
+		err := sink.wav.write(frame)
+		if err != nil {
+			return err
+		}
+		sink.frames++
+		clear(frame)
+	}
+	return nil
+}
+
+func (sub *Peer) connectMixer(m *mixer) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	var renegotiate bool
+	err := lockRunWithTimeout(func() error {
+		old := m.outputs[sub.cid]
+		if old != nil && !sub.mixed {
+			err := sub.pc.RemoveTrack(old.sender)
+			if err != nil {
+				return fmt.Errorf("pc.RemoveTrack(%s, mixed) => %v", sub.id(), err)
+			}
+			delete(m.outputs, sub.cid)
+			renegotiate = true
+		}
+		if old == nil && sub.mixed {
+			codec := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: opusSampleRate, Channels: 2}
+			lt, err := webrtc.NewTrackLocalStaticSample(codec, uuid.Must(uuid.NewV4()).String(), "mixed")
+			if err != nil {
+				return buildError(ErrorServerNewTrack, err)
+			}
+			out, err := newMixerOutput(sub.uid, lt)
+			if err != nil {
+				return buildError(ErrorServerNewTrack, err)
+			}
+			out.sender, err = sub.pc.AddTrack(lt)
+			logger.Printf("pc.AddTrack(%s, mixed) => %v %v", sub.id(), out.sender, err)
+			if err != nil {
+				return fmt.Errorf("pc.AddTrack(%s, mixed) => %v", sub.id(), err)
+			}
+			m.outputs[sub.cid] = out
+			if !m.running {
+				m.running = true
+				go m.loop()
+			}
+			renegotiate = true
+		}
+		return nil
+	}, peerTrackReadTimeout)
+	return renegotiate, err
+}
+
+func clampInt16(s int32) int16 {
+	return int16(max(min(s, math.MaxInt16), math.MinInt16))
+}
@@ -0,0 +1,55 @@
+package engine
+
+import (
+	"math"
+	"testing"
+
+	"github.com/pion/opus"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestMixerOutputOpus(t *testing.T) {
+	codec := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: opusSampleRate, Channels: 2}
+	local, err := webrtc.NewTrackLocalStaticSample(codec, "mixed", "mixed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := newMixerOutput("uid", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder, err := opus.NewDecoderWithOutput(mixerSampleRate, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var energy float64
+	for f := range 50 {
+		frame := make([]int16, mixerFrameSamples)
+		for i := range frame {
+			x := float64(f*mixerFrameSamples+i) / mixerSampleRate
+			frame[i] = int16(8000 * math.Sin(2*math.Pi*440*x))
+		}
+		packet, err := out.encode(frame)
+		if err != nil {
+			t.Fatalf("encode(%d) => %v", f, err)
+		}
+		if samples := opusPacketSamples(packet); samples != opusSampleRate/50 {
+			t.Fatalf("encode(%d) => %d samples", f, samples)
+		}
+		pcm := make([]int16, mixerDecodeCapacity)
+		n, err := decoder.DecodeToInt16(packet, pcm)
+		if err != nil {
+			t.Fatalf("decode(%d) => %v", f, err)
+		}
+		if n != mixerFrameSamples {
+			t.Fatalf("decode(%d) => %d samples", f, n)
+		}
+		for _, s := range pcm[:n] {
+			energy += float64(s) * float64(s)
+		}
+	}
+	if energy == 0 {
+		t.Fatalf("decoded mix is silent")
+	}
+}
@@ -0,0 +1,52 @@
+package engine
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/pion/ice/v4"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	muxTCPReadBufferSize = 8
+)
+
+// buildICEMux binds the shared ports once, all peer connections then use
+// them instead of an ephemeral port each, the connections are told apart
+// by their ICE username fragments
+func (engine *Engine) buildICEMux(udpPort, tcpPort int) error {
+	if udpPort > 0 {
+		mux, err := ice.NewMultiUDPMuxFromPort(udpPort, ice.UDPMuxFromPortWithInterfaceFilter(func(in string) bool {
+			return in == engine.Interface
+		}))
+		if err != nil {
+			return fmt.Errorf("ice udp mux on port %d %v", udpPort, err)
+		}
+		engine.udpMux = mux
+	}
+	if tcpPort > 0 {
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: tcpPort})
+		if err != nil {
+			return fmt.Errorf("ice tcp mux on port %d %v", tcpPort, err)
+		}
+		engine.tcpMux = webrtc.NewICETCPMux(nil, listener, muxTCPReadBufferSize)
+	}
+	logger.Printf("engine.buildICEMux(UDP: %d, TCP: %d)\n", udpPort, tcpPort)
+	return nil
+}
+
+func (engine *Engine) configureICEMux(se *webrtc.SettingEngine) error {
+	networks := []webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6}
+	if engine.tcpMux != nil {
+		se.SetICETCPMux(engine.tcpMux)
+		networks = append(networks, webrtc.NetworkTypeTCP4, webrtc.NetworkTypeTCP6)
+	}
+	se.SetNetworkTypes(networks)
+	if engine.udpMux != nil {
+		se.SetICEUDPMux(engine.udpMux)
+		return nil
+	}
+	return se.SetEphemeralUDPPortRange(engine.PortMin, engine.PortMax)
+}
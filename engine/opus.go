@@ -0,0 +1,72 @@
+package engine
+
+const (
+	opusSampleRate        = 48000
+	opusCeltFullbandFrame = 31
+)
+
+var (
+	opusFrameSamples = [32]int{
+		480, 960, 1920, 2880, 480, 960, 1920, 2880, 480, 960, 1920, 2880,
+		480, 960, 480, 960,
+		120, 240, 480, 960, 120, 240, 480, 960, 120, 240, 480, 960, 120, 240, 480, 960,
+	}
+	opusSilenceFrame = []byte{0xff, 0xfe}
+)
+
+func opusPacketSamples(payload []byte) int {
+	if len(payload) < 1 {
+		return 0
+	}
+	toc := payload[0]
+	frames := 0
+	switch toc & 0x3 {
+	case 0:
+		frames = 1
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(payload) < 2 {
+			return 0
+		}
+		frames = int(payload[1] & 0x3f)
+	}
+	samples := frames * opusFrameSamples[toc>>3]
+	if samples > opusSampleRate*120/1000 {
+		return 0
+	}
+	return samples
+}
+
+// opusSilence builds a CELT fullband packet made of silence frames, which lasts
+// exactly as long as the original payload so RTP timestamps stay continuous
+func opusSilence(payload []byte) []byte {
+	samples := opusPacketSamples(payload)
+	if samples == 0 {
+		samples = 960
+	}
+	return opusSilenceSamples(samples)
+}
+
+func opusSilenceSamples(samples int) []byte {
+	config, size := opusCeltFullbandFrame, 960
+	for samples%size != 0 && config > 28 {
+		config, size = config-1, size/2
+	}
+	toc := byte(config << 3)
+	count := samples / size
+
+	var silence []byte
+	switch count {
+	case 1:
+		silence = append(silence, toc)
+	case 2:
+		silence = append(silence, toc|0x1)
+	default:
+		silence = append(silence, toc|0x3, byte(count))
+	}
+	for range count {
+		silence = append(silence, opusSilenceFrame...)
+	}
+	return silence
+}
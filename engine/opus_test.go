@@ -0,0 +1,62 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/pion/opus"
+)
+
+func TestOpusSilenceSamples(t *testing.T) {
+	for samples := 120; samples <= 5760; samples += 120 {
+		silence := opusSilenceSamples(samples)
+		if got := opusPacketSamples(silence); got != samples {
+			t.Fatalf("opusPacketSamples(%d) => %d", samples, got)
+		}
+		decodeSilence(t, silence, samples)
+	}
+}
+
+func TestOpusSilence(t *testing.T) {
+	cases := []struct {
+		name    string
+		payload []byte
+		samples int
+	}{
+		{"silk 20ms", []byte{0x48, 0x01, 0x02}, 960},
+		{"hybrid 20ms", []byte{0x68, 0x01, 0x02}, 960},
+		{"celt 2.5ms", []byte{0x80, 0x01}, 120},
+		{"celt 2x10ms", []byte{0xf1, 0x01}, 960},
+		{"celt 6x20ms", []byte{0xfb, 0x06, 0x01}, 5760},
+		{"celt 3x2.5ms", []byte{0x83, 0x03, 0x01}, 360},
+		{"empty", []byte{}, 960},
+	}
+	for _, c := range cases {
+		silence := opusSilence(c.payload)
+		if got := opusPacketSamples(silence); got != c.samples {
+			t.Fatalf("opusSilence(%s) lasts %d samples, expect %d", c.name, got, c.samples)
+		}
+		decodeSilence(t, silence, c.samples)
+	}
+}
+
+func decodeSilence(t *testing.T, packet []byte, samples int) {
+	t.Helper()
+
+	decoder, err := opus.NewDecoderWithOutput(opusSampleRate, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcm := make([]int16, opusSampleRate*120/1000)
+	n, err := decoder.DecodeToInt16(packet, pcm)
+	if err != nil {
+		t.Fatalf("decode %x => %v", packet, err)
+	}
+	if n != samples {
+		t.Fatalf("decode %x => %d samples, expect %d", packet, n, samples)
+	}
+	for i, s := range pcm[:n] {
+		if s != 0 {
+			t.Fatalf("decode %x => sample %d is %d", packet, i, s)
+		}
+	}
+}
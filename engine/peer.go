@@ -1,16 +1,15 @@
 package engine
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
 	"io"
-	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/MixinNetwork/mixin/logger"
 	"github.com/gofrs/uuid/v5"
+	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
 )
@@ -19,49 +18,64 @@ const (
 	peerTrackClosedId          = "CLOSED"
 	peerTrackConnectionTimeout = 20 * time.Second
 	peerTrackReadTimeout       = 5 * time.Second
+	peerKeyframeRequestPeriod  = 500 * time.Millisecond
 )
 
-var clbkClient *http.Client
-
-func init() {
-	clbkClient = &http.Client{
-		Timeout: 5 * time.Second,
-	}
-}
-
 type Sender struct {
 	id  string
+	uid string
 	rtp *webrtc.RTPSender
 }
 
+type Track struct {
+	id        string
+	kind      webrtc.RTPCodecType
+	ssrc      webrtc.SSRC
+	local     *webrtc.TrackLocalStaticRTP
+	queue     chan *rtp.Packet
+	keyframed atomic.Int64
+	levelId   uint8
+	level     atomic.Uint64
+	levelAt   atomic.Int64
+}
+
 type Peer struct {
 	sync.RWMutex
+	room       *pmap
 	rid        string
 	uid        string
 	cid        string
 	callback   string
-	listenOnly bool
+	listenOnly atomic.Bool
+	role       string
+	relay      string
+	mixed      bool
 	pc         *webrtc.PeerConnection
-	track      *webrtc.TrackLocalStaticRTP
+	tracks     map[string]*Track
 	publishers map[string]*Sender
-	queue      chan *rtp.Packet
+	signaler   signaler
 	connected  chan bool
+	closedAt   time.Time
 }
 
-func BuildPeer(rid, uid string, pc *webrtc.PeerConnection, callback string, listenOnly bool) *Peer {
+// BuildPeer sets the role before the handlers of the connection start, the
+// connected state of a listener depends on it
+func BuildPeer(room *pmap, uid string, pc *webrtc.PeerConnection, callback string, listenOnly bool, role string) *Peer {
 	cid, err := uuid.NewV4()
 	if err != nil {
 		panic(err)
 	}
 	peer := new(Peer)
-	peer.rid = rid
+	peer.room = room
+	peer.rid = room.id
 	peer.uid = uid
 	peer.cid = cid.String()
 	peer.pc = pc
 	peer.callback = callback
-	peer.listenOnly = listenOnly
+	peer.listenOnly.Store(listenOnly)
+	peer.role = role
 	peer.connected = make(chan bool, 1)
-	peer.queue = make(chan *rtp.Packet, 8)
+	peer.tracks = make(map[string]*Track)
 	peer.publishers = make(map[string]*Sender)
 	peer.handle()
 	return peer
@@ -71,25 +85,35 @@ func (p *Peer) id() string {
 	return fmt.Sprintf("%s:%s:%s", p.rid, p.uid, p.cid)
 }
 
-func (p *Peer) CloseWithTimeout() error {
+func (p *Peer) CloseWithTimeout(reason string) error {
 	logger.Printf("PeerClose(%s) now\n", p.id())
 	p.Lock()
 	defer p.Unlock()
 
 	err := lockRunWithTimeout(func() error {
-		return p.close()
+		return p.close(reason)
 	}, peerTrackReadTimeout)
 	logger.Printf("PeerClose(%s) with %v\n", p.id(), err)
 	return err
 }
 
-func (p *Peer) close() error {
+func (p *Peer) close(reason string) error {
 	if p.cid == peerTrackClosedId {
 		return nil
 	}
+	if reason != "" {
+		p.room.webhook.peer(p, webhookEventLeave, reason)
+		metricPeersLeft.WithLabelValues(reason).Inc()
+	}
 
-	p.track = nil
+	go p.room.viewers.closePeer(p.rid, p.uid, p.cid)
+	p.tracks = make(map[string]*Track)
 	p.cid = peerTrackClosedId
+	p.closedAt = time.Now()
+	p.room.renegotiate()
+	if reason != "" {
+		go p.room.checkEmpty()
+	}
 	return p.pc.Close()
 }
 
@@ -102,7 +126,7 @@ func (peer *Peer) handle() {
 		case <-peer.connected:
 		case <-timer.C:
 			logger.Printf("HandlePeer(%s) OnTrackTimeout()\n", peer.id())
-			_ = peer.CloseWithTimeout()
+			_ = peer.CloseWithTimeout(leaveReasonTimeout)
 		}
 	}()
 
@@ -111,130 +135,218 @@ func (peer *Peer) handle() {
 	})
 	peer.pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
 		logger.Printf("HandlePeer(%s) OnConnectionStateChange(%s)\n", peer.id(), state)
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			if peer.role != peerRoleListener {
+				return
+			}
+			select {
+			case peer.connected <- true:
+			default:
+			}
+		case webrtc.PeerConnectionStateFailed:
+			if len(peer.tracksCopy()) == 0 {
+				_ = peer.CloseWithTimeout(leaveReasonFailed)
+			}
+		}
 	})
 	peer.pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
 		logger.Printf("HandlePeer(%s) OnICEConnectionStateChange(%s)\n", peer.id(), state)
+		metricICEStates.WithLabelValues(state.String()).Inc()
 	})
 	peer.pc.OnTrack(func(rt *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
 		logger.Printf("HandlePeer(%s) OnTrack(%s, %d, %d)\n", peer.id(), rt.ID(), rt.PayloadType(), rt.SSRC())
-		added, err := peer.addTrackFromRemote(rt)
+		track, primary, err := peer.addTrackFromRemote(rt, receiver)
 		if err != nil {
 			panic(err)
 		}
-		if !added {
+		if track == nil {
 			return
 		}
-		peer.connected <- true
+		select {
+		case peer.connected <- true:
+		default:
+		}
+		peer.room.renegotiate()
 
-		err = peer.callbackOnTrack()
-		if err != nil {
-			logger.Printf("HandlePeer(%s) OnTrack(%d, %d) callback error %v\n", peer.id(), rt.PayloadType(), rt.SSRC(), err)
+		if primary {
+			peer.room.webhook.peer(peer, webhookEventOnTrack, "")
+		}
+
+		if track.kind == webrtc.RTPCodecTypeVideo {
+			err = peer.copyVideo(rt, track)
+		} else {
+			err = peer.copyTrack(rt, track)
+		}
+		logger.Printf("HandlePeer(%s) OnTrack(%s, %d, %d) end with %v\n", peer.id(), track.id, rt.PayloadType(), rt.SSRC(), err)
+		if primary {
+			err = peer.CloseWithTimeout(leaveReasonTrack)
 		} else {
-			err = peer.copyTrack(rt)
-			logger.Printf("HandlePeer(%s) OnTrack(%d, %d) end with %v\n", peer.id(), rt.PayloadType(), rt.SSRC(), err)
+			peer.removeTrack(track)
 		}
-		err = peer.CloseWithTimeout()
-		logger.Printf("HandlePeer(%s) OnTrack(%d, %d) DONE %v\n", peer.id(), rt.PayloadType(), rt.SSRC(), err)
+		logger.Printf("HandlePeer(%s) OnTrack(%s, %d, %d) DONE %v\n", peer.id(), track.id, rt.PayloadType(), rt.SSRC(), err)
 	})
 }
 
-func (peer *Peer) addTrackFromRemote(rt *webrtc.TrackRemote) (bool, error) {
+func (peer *Peer) addTrackFromRemote(rt *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) (*Track, bool, error) {
 	peer.Lock()
 	defer peer.Unlock()
 
 	if peer.cid == peerTrackClosedId {
-		return false, nil
+		return nil, false, nil
 	}
 
 	rpt := rt.PayloadType()
-	if peer.track != nil || (rpt != 111 && rpt != 109) {
-		return false, nil
+	if rt.Kind() == webrtc.RTPCodecTypeAudio && rpt != 111 && rpt != 109 {
+		return nil, false, nil
 	}
-	lt, err := webrtc.NewTrackLocalStaticRTP(rt.Codec().RTPCodecCapability, peer.cid, peer.uid)
+
+	id, primary := peer.cid, true
+	if peer.tracks[id] != nil || rt.Kind() != webrtc.RTPCodecTypeAudio {
+		id, primary = uuid.Must(uuid.NewV4()).String(), false
+	}
+	lt, err := webrtc.NewTrackLocalStaticRTP(rt.Codec().RTPCodecCapability, id, peer.uid)
 	if err != nil {
-		return false, err
+		return nil, false, err
+	}
+	track := &Track{
+		id:    id,
+		kind:  rt.Kind(),
+		ssrc:  rt.SSRC(),
+		local: lt,
+		queue: make(chan *rtp.Packet, 8),
+	}
+	if track.kind == webrtc.RTPCodecTypeAudio {
+		track.levelId = audioLevelExtensionId(receiver)
 	}
-	peer.track = lt
-	return true, nil
+	peer.tracks[id] = track
+	return track, primary, nil
 }
 
-func (peer *Peer) callbackOnTrack() error {
-	if peer.callback == "" {
-		return nil
+func (peer *Peer) removeTrack(track *Track) {
+	peer.Lock()
+	defer peer.Unlock()
+
+	if peer.tracks[track.id] == track {
+		delete(peer.tracks, track.id)
+		peer.room.renegotiate()
 	}
+}
 
-	body, _ := json.Marshal(map[string]string{
-		"rid":    peer.rid,
-		"uid":    peer.uid,
-		"cid":    peer.cid,
-		"action": "ontrack",
-	})
-	req, err := http.NewRequest("POST", peer.callback, bytes.NewReader(body))
-	if err != nil {
-		return err
+func (p *Peer) tracksCopy() []*Track {
+	p.RLock()
+	defer p.RUnlock()
+
+	tracks := make([]*Track, 0, len(p.tracks))
+	for _, t := range p.tracks {
+		tracks = append(tracks, t)
 	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := clbkClient.Do(req)
-	if err != nil {
-		return err
+	return tracks
+}
+
+// readSenderRTCP records the receiver reports of a subscriber, and forwards
+// its keyframe requests to the publisher
+func (pub *Peer) readSenderRTCP(track *Track, sender *webrtc.RTPSender) {
+	for {
+		pkts, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, pkt := range pkts {
+			switch p := pkt.(type) {
+			case *rtcp.ReceiverReport:
+				observeReceiverReport(track, sender, p)
+				continue
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+			default:
+				continue
+			}
+			now := time.Now().UnixNano()
+			last := track.keyframed.Load()
+			if now-last < int64(peerKeyframeRequestPeriod) || !track.keyframed.CompareAndSwap(last, now) {
+				continue
+			}
+			err = pub.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.ssrc)}})
+			logger.Verbosef("readSenderRTCP(%s, %d) => %v\n", pub.id(), track.ssrc, err)
+		}
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("status: %d", resp.StatusCode)
+func (peer *Peer) copyVideo(src *webrtc.TrackRemote, track *Track) error {
+	for {
+		pkt, _, err := src.ReadRTP()
+		if err != nil {
+			return err
+		}
+		if peer.role == peerRoleListener {
+			continue
+		}
+		err = track.local.WriteRTP(pkt)
+		if err != nil {
+			return fmt.Errorf("peer %s track %s write %v", peer.uid, track.id, err)
+		}
+		observeForward(track, pkt)
 	}
-	return nil
 }
 
-func (peer *Peer) copyTrack(src *webrtc.TrackRemote) error {
+func (peer *Peer) copyTrack(src *webrtc.TrackRemote, track *Track) error {
 	go func() {
-		defer close(peer.queue)
+		defer close(track.queue)
 
 		for {
 			pkt, _, err := src.ReadRTP()
 			if err == io.EOF {
-				logger.Verbosef("copyTrack(%s) EOF\n", peer.id())
+				logger.Verbosef("copyTrack(%s, %s) EOF\n", peer.id(), track.id)
 				return
 			}
 			if err != nil {
-				logger.Verbosef("copyTrack(%s) error %s\n", peer.id(), err.Error())
+				logger.Verbosef("copyTrack(%s, %s) error %s\n", peer.id(), track.id, err.Error())
 				return
 			}
-			peer.queue <- pkt
+			track.queue <- pkt
 		}
 	}()
 
 	for {
-		err := peer.consumeQueue()
+		err := peer.consumeQueue(track)
 		if err != nil {
 			return err
 		}
 	}
 }
 
-func (peer *Peer) consumeQueue() error {
+func (peer *Peer) consumeQueue(track *Track) error {
 	timer := time.NewTimer(peerTrackReadTimeout)
 	defer timer.Stop()
 
 	select {
-	case pkt, ok := <-peer.queue:
+	case pkt, ok := <-track.queue:
 		if !ok {
-			return fmt.Errorf("peer %s queue closed", peer.uid)
+			return fmt.Errorf("peer %s track %s queue closed", peer.uid, track.id)
 		}
-		track := peer.track
-		if track == nil {
+		if peer.cid == peerTrackClosedId {
 			return fmt.Errorf("peer %s closed", peer.uid)
 		}
-		if peer.listenOnly {
-			// FIXME make real silent opus packet
-			pkt.Payload = make([]byte, len(pkt.Payload))
+		if peer.role == peerRoleListener {
+			return nil
+		}
+		muted := peer.listenOnly.Load()
+		track.updateLevel(pkt, muted)
+		if muted {
+			pkt.Payload = opusSilence(pkt.Payload)
 		}
-		err := track.WriteRTP(pkt)
+		err := track.local.WriteRTP(pkt)
 		if err != nil {
-			return fmt.Errorf("peer %s track write %v", peer.uid, err)
+			return fmt.Errorf("peer %s track %s write %v", peer.uid, track.id, err)
+		}
+		observeForward(track, pkt)
+		peer.room.forwardLastN(track, pkt)
+		peer.room.mixer.write(peer.uid, track, pkt)
+		if rec := peer.room.recorder.Load(); rec != nil {
+			rec.write(peer, track, pkt)
 		}
 	case <-timer.C:
-		return fmt.Errorf("peer %s track read timeout", peer.uid)
+		return fmt.Errorf("peer %s track %s read timeout", peer.uid, track.id)
 	}
 
 	return nil
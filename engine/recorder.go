@@ -0,0 +1,286 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/gofrs/uuid/v5"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+)
+
+const (
+	recorderIdleTimeout   = peerTrackReadTimeout
+	recorderCheckPeriod   = time.Second
+	recorderMaximumPacket = opusSampleRate * 120 / 1000
+)
+
+type recordingTrack struct {
+	Uid      string     `json:"uid"`
+	Cid      string     `json:"cid"`
+	Track    string     `json:"track"`
+	File     string     `json:"file"`
+	JoinedAt time.Time  `json:"joined_at"`
+	LeftAt   *time.Time `json:"left_at,omitempty"`
+
+	writer   *oggwriter.OggWriter
+	nextTs   uint32
+	updateAt time.Time
+}
+
+type recorder struct {
+	sync.Mutex
+	Room      string            `json:"rid"`
+	Id        string            `json:"id"`
+	StartedAt time.Time         `json:"started_at"`
+	StoppedAt *time.Time        `json:"stopped_at,omitempty"`
+	Tracks    []*recordingTrack `json:"tracks"`
+	Mixed     string            `json:"mixed,omitempty"`
+
+	room      *pmap
+	directory string
+	writers   map[string]*recordingTrack
+	done      chan struct{}
+}
+
+func (room *pmap) startRecording(directory string, mixed bool) (*recorder, error) {
+	if directory == "" {
+		return nil, buildError(ErrorRecordingDisabled, fmt.Errorf("recording disabled"))
+	}
+
+	room.Lock()
+	defer room.Unlock()
+
+	if rec := room.recorder.Load(); rec != nil {
+		return rec, nil
+	}
+	now := time.Now().UTC()
+	id := fmt.Sprintf("%s-%s", now.Format("20060102T150405Z"), uuid.Must(uuid.NewV4()).String()[:8])
+	rec := &recorder{
+		Room:      room.id,
+		Id:        id,
+		StartedAt: now,
+		Tracks:    make([]*recordingTrack, 0),
+		room:      room,
+		directory: filepath.Join(directory, fmt.Sprintf("%s-%s", room.id, id)),
+		writers:   make(map[string]*recordingTrack),
+		done:      make(chan struct{}),
+	}
+	err := os.MkdirAll(rec.directory, 0750)
+	if err != nil {
+		return nil, buildError(ErrorServerRecording, err)
+	}
+	if mixed {
+		rec.Mixed = "mixed.wav"
+		wav, err := createWav(filepath.Join(rec.directory, rec.Mixed), mixerSampleRate)
+		if err != nil {
+			return nil, buildError(ErrorServerRecording, err)
+		}
+		room.mixer.attach(wav)
+	}
+	err = rec.writeManifest()
+	if err != nil {
+		if wav := room.mixer.detach(); wav != nil {
+			_ = wav.close()
+		}
+		return nil, buildError(ErrorServerRecording, err)
+	}
+	room.recorder.Store(rec)
+	go rec.loop()
+	logger.Printf("startRecording(%s) => %s\n", room.id, rec.directory)
+	return rec, nil
+}
+
+func (room *pmap) stopRecording() *recorder {
+	room.Lock()
+	defer room.Unlock()
+
+	rec := room.recorder.Swap(nil)
+	if rec == nil {
+		return nil
+	}
+	err := rec.stop()
+	logger.Printf("stopRecording(%s) => %s %v\n", room.id, rec.directory, err)
+	return rec
+}
+
+func (rec *recorder) write(peer *Peer, track *Track, pkt *rtp.Packet) {
+	rec.Lock()
+	defer rec.Unlock()
+
+	if rec.StoppedAt != nil {
+		return
+	}
+	rt := rec.writers[track.id]
+	if rt == nil {
+		file := rec.segmentFile(peer.uid, track.id)
+		writer, err := oggwriter.New(filepath.Join(rec.directory, file), opusSampleRate, 2)
+		if err != nil {
+			logger.Printf("recorder.write(%s, %s) => %v\n", rec.Id, file, err)
+			return
+		}
+		rt = &recordingTrack{
+			Uid:      peer.uid,
+			Cid:      peer.cid,
+			Track:    track.id,
+			File:     file,
+			JoinedAt: time.Now().UTC(),
+			writer:   writer,
+			nextTs:   pkt.Timestamp,
+			updateAt: time.Now(),
+		}
+		rec.writers[track.id] = rt
+		rec.Tracks = append(rec.Tracks, rt)
+		_ = rec.writeManifest()
+	}
+
+	err := rt.write(pkt)
+	if err != nil {
+		logger.Verbosef("recorder.write(%s, %s) => %v\n", rec.Id, rt.File, err)
+	}
+}
+
+// segmentFile numbers the later segments of a track, the writer of a track
+// closes when idle, e.g. a demoted speaker, and must never truncate the
+// earlier segments once the track resumes
+func (rec *recorder) segmentFile(uid, track string) string {
+	files := make(map[string]bool, len(rec.Tracks))
+	for _, rt := range rec.Tracks {
+		files[rt.File] = true
+	}
+	file := fmt.Sprintf("%s-%s.ogg", uid, track)
+	for i := 2; files[file]; i++ {
+		file = fmt.Sprintf("%s-%s-%d.ogg", uid, track, i)
+	}
+	return file
+}
+
+// write fills the gaps in RTP timestamps with silence, because the granule
+// position of the Ogg page is the sum of all packet durations
+func (rt *recordingTrack) write(pkt *rtp.Packet) error {
+	samples := opusPacketSamples(pkt.Payload)
+	if samples == 0 {
+		return nil
+	}
+	gap := int64(int32(pkt.Timestamp - rt.nextTs))
+	if gap < 0 {
+		return nil
+	}
+	elapsed := int64((time.Since(rt.updateAt) + time.Second).Seconds() * opusSampleRate)
+	for gap = min(gap, elapsed); gap >= 120; {
+		chunk := min(gap, recorderMaximumPacket)
+		if chunk >= 960 {
+			chunk -= chunk % 960
+		} else {
+			chunk -= chunk % 120
+		}
+		err := rt.writer.WriteRTP(&rtp.Packet{Payload: opusSilenceSamples(int(chunk))})
+		if err != nil {
+			return err
+		}
+		gap -= chunk
+	}
+
+	rt.nextTs = pkt.Timestamp + uint32(samples)
+	rt.updateAt = time.Now()
+	return rt.writer.WriteRTP(pkt)
+}
+
+func (rt *recordingTrack) close(at time.Time) error {
+	if rt.LeftAt != nil {
+		return nil
+	}
+	left := at.UTC()
+	rt.LeftAt = &left
+	return rt.writer.Close()
+}
+
+func (rec *recorder) loop() {
+	ticker := time.NewTicker(recorderCheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rec.done:
+			return
+		case <-ticker.C:
+		}
+
+		if rec.room.empty() && rec.recorded() {
+			logger.Printf("recorder.loop(%s) room empty\n", rec.Id)
+			rec.room.stopRecording()
+			return
+		}
+
+		rec.Lock()
+		for id, rt := range rec.writers {
+			if time.Since(rt.updateAt) < recorderIdleTimeout {
+				continue
+			}
+			err := rt.close(rt.updateAt)
+			logger.Printf("recorder.close(%s, %s) => %v\n", rec.Id, rt.File, err)
+			delete(rec.writers, id)
+			_ = rec.writeManifest()
+		}
+		rec.Unlock()
+	}
+}
+
+func (rec *recorder) recorded() bool {
+	rec.Lock()
+	defer rec.Unlock()
+
+	return len(rec.Tracks) > 0
+}
+
+func (rec *recorder) stop() error {
+	if wav := rec.room.mixer.detach(); wav != nil {
+		err := wav.close()
+		logger.Printf("recorder.close(%s, %s) => %v\n", rec.Id, rec.Mixed, err)
+	}
+
+	rec.Lock()
+	defer rec.Unlock()
+
+	close(rec.done)
+	now := time.Now().UTC()
+	rec.StoppedAt = &now
+	for id, rt := range rec.writers {
+		err := rt.close(now)
+		logger.Printf("recorder.close(%s, %s) => %v\n", rec.Id, rt.File, err)
+		delete(rec.writers, id)
+	}
+	return rec.writeManifest()
+}
+
+func (rec *recorder) writeManifest() error {
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(rec.directory, "manifest.json")
+	err = os.WriteFile(path+".tmp", data, 0640)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (rec *recorder) info() map[string]any {
+	rec.Lock()
+	defer rec.Unlock()
+
+	return map[string]any{
+		"id":         rec.Id,
+		"directory":  rec.directory,
+		"started_at": rec.StartedAt,
+		"stopped_at": rec.StoppedAt,
+		"tracks":     len(rec.Tracks),
+		"mixed":      rec.Mixed,
+	}
+}
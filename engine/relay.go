@@ -0,0 +1,415 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/gofrs/uuid/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	relayPollPeriod  = 2 * time.Second
+	relayIdleTimeout = 60 * time.Second
+	relayTokenExpiry = 10 * time.Minute
+)
+
+// relay pulls every native publisher of a room on the origin engine through
+// its WHEP endpoint, and re-publishes the tracks as a virtual peer of the
+// local room, so a room can span several engines
+type relay struct {
+	rid       string
+	origin    string
+	secret    []byte
+	router    *Router
+	client    *http.Client
+	peers     map[string]*relayPeer
+	startedAt time.Time
+	cancel    context.CancelFunc
+}
+
+type relayPeer struct {
+	peer     *Peer
+	cid      string
+	tracks   string
+	location string
+}
+
+type relayRemote struct {
+	Id     string `json:"id"`
+	Track  string `json:"track"`
+	Tracks []struct {
+		Id   string `json:"id"`
+		Kind string `json:"kind"`
+	} `json:"tracks"`
+	Mute  bool   `json:"mute"`
+	Role  string `json:"role"`
+	Relay string `json:"relay"`
+}
+
+type relayMap struct {
+	sync.Mutex
+	m map[string]*relay
+}
+
+func relayMapAllocate() *relayMap {
+	return &relayMap{m: make(map[string]*relay)}
+}
+
+func (r *Router) relay(rid, origin string, secret []byte) (map[string]any, error) {
+	if r.engine.draining.Load() {
+		return nil, buildError(ErrorServerDraining, fmt.Errorf("engine draining"))
+	}
+	if err := validateId(rid); err != nil {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid rid format %s %s", rid, err.Error()))
+	}
+	if !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid origin %s", origin))
+	}
+	origin = strings.TrimSuffix(origin, "/")
+	if !r.engine.allowOrigin(origin) {
+		return nil, buildError(ErrorRelayForbidden, fmt.Errorf("origin %s not allowed", origin))
+	}
+
+	rm := r.engine.relays
+	rm.Lock()
+	defer rm.Unlock()
+
+	key := rid + " " + origin
+	if rl := rm.m[key]; rl != nil {
+		return rl.summary(), nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	rl := &relay{
+		rid:    rid,
+		origin: origin,
+		secret: secret,
+		router: r,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		peers:     make(map[string]*relayPeer),
+		startedAt: time.Now(),
+		cancel:    cancel,
+	}
+	rm.m[key] = rl
+	r.engine.GetRoom(rid)
+	go rl.loop(ctx)
+	return rl.summary(), nil
+}
+
+// relayOrigins normalizes the configured origins, only these engines are
+// ever contacted by a relay, and only they receive the relay tokens
+func relayOrigins(origins []string) []string {
+	list := make([]string, 0, len(origins))
+	for _, o := range origins {
+		list = append(list, strings.TrimSuffix(o, "/"))
+	}
+	return list
+}
+
+func (engine *Engine) allowOrigin(origin string) bool {
+	for _, o := range engine.Origins {
+		if o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Router) unrelay(rid, origin string) (map[string]any, error) {
+	rm := r.engine.relays
+	rm.Lock()
+	defer rm.Unlock()
+
+	rl := rm.m[rid+" "+strings.TrimSuffix(origin, "/")]
+	if rl == nil {
+		return nil, buildError(ErrorRelayNotFound, fmt.Errorf("relay %s not found from %s", rid, origin))
+	}
+	rl.cancel()
+	return rl.summary(), nil
+}
+
+func (rl *relay) summary() map[string]any {
+	return map[string]any{
+		"rid":        rl.rid,
+		"origin":     rl.origin,
+		"started_at": rl.startedAt,
+	}
+}
+
+// loop stops once the engine drains, or no local peer has been in the
+// room for a while, there is nobody to relay the streams to
+func (rl *relay) loop(ctx context.Context) {
+	logger.Printf("relay.loop(%s, %s) started\n", rl.rid, rl.origin)
+	ticker := time.NewTicker(relayPollPeriod)
+	defer ticker.Stop()
+
+	activeAt := time.Now()
+	for !rl.router.engine.draining.Load() {
+		room := rl.router.engine.GetRoom(rl.rid)
+		if room.natives() > 0 {
+			activeAt = time.Now()
+		} else if time.Since(activeAt) > relayIdleTimeout {
+			break
+		}
+		err := rl.sync(room)
+		if err != nil {
+			logger.Printf("relay.sync(%s, %s) => %v\n", rl.rid, rl.origin, err)
+		}
+		select {
+		case <-ctx.Done():
+			rl.stop()
+			return
+		case <-ticker.C:
+		}
+	}
+	rl.stop()
+}
+
+func (rl *relay) stop() {
+	for uid, rp := range rl.peers {
+		rl.drop(uid, rp)
+	}
+	rm := rl.router.engine.relays
+	rm.Lock()
+	if rm.m[rl.rid+" "+rl.origin] == rl {
+		delete(rm.m, rl.rid+" "+rl.origin)
+	}
+	rm.Unlock()
+	rl.cancel()
+	logger.Printf("relay.loop(%s, %s) stopped\n", rl.rid, rl.origin)
+}
+
+func (room *pmap) natives() int {
+	var natives int
+	for _, p := range room.PeersCopy() {
+		if p.cid != peerTrackClosedId && p.relay == "" {
+			natives += 1
+		}
+	}
+	return natives
+}
+
+// sync skips the remote peers relayed from other engines, so that engines
+// relaying a room from each other never pull their own streams back
+func (rl *relay) sync(room *pmap) error {
+	remotes, err := rl.list()
+	if err != nil {
+		return err
+	}
+	wanted := make(map[string]*relayRemote)
+	for _, p := range remotes {
+		if p.Relay != "" || p.Role == peerRoleListener || len(p.Tracks) == 0 {
+			continue
+		}
+		wanted[p.Id] = p
+	}
+
+	for uid, rp := range rl.peers {
+		p := wanted[uid]
+		if p != nil && p.Track == rp.cid && p.tracksKey() == rp.tracks && rp.peer.cid != peerTrackClosedId {
+			rp.peer.listenOnly.Store(p.Mute)
+			continue
+		}
+		rl.drop(uid, rp)
+	}
+	for uid, p := range wanted {
+		if rl.peers[uid] != nil {
+			continue
+		}
+		if old := room.PeersCopy()[uid]; old != nil && old.cid != peerTrackClosedId {
+			continue
+		}
+		rp, err := rl.pull(room, p)
+		logger.Printf("relay.pull(%s, %s, %s) => %v\n", rl.rid, rl.origin, uid, err)
+		if err != nil {
+			continue
+		}
+		rl.peers[uid] = rp
+	}
+	return nil
+}
+
+func (rl *relay) pull(room *pmap, remote *relayRemote) (*relayPeer, error) {
+	pc, err := rl.router.buildPeerConnection(false)
+	if err != nil {
+		return nil, err
+	}
+	var location string
+	var answer *webrtc.SessionDescription
+	err = lockRunWithTimeout(func() error {
+		for _, t := range remote.Tracks {
+			_, err := pc.AddTransceiverFromKind(webrtc.NewRTPCodecType(t.Kind), webrtc.RTPTransceiverInit{
+				Direction: webrtc.RTPTransceiverDirectionRecvonly,
+			})
+			if err != nil {
+				return buildError(ErrorServerAddTransceiver, err)
+			}
+		}
+		offer, err := pc.CreateOffer(nil)
+		if err != nil {
+			return buildError(ErrorServerCreateOffer, err)
+		}
+		err = setLocalDescription(pc, offer)
+		if err != nil {
+			return buildError(ErrorServerSetLocalOffer, err)
+		}
+		location, answer, err = rl.whep(remote.Id, pc.LocalDescription().SDP)
+		return err
+	}, peerTrackConnectionTimeout)
+	if err != nil {
+		_ = pc.Close()
+		return nil, err
+	}
+
+	room.Lock()
+	if old := room.m[remote.Id]; old != nil && old.cid != peerTrackClosedId {
+		room.Unlock()
+		_ = pc.Close()
+		rl.delete(location)
+		return nil, fmt.Errorf("peer %s already in %s", remote.Id, rl.rid)
+	}
+	peer := BuildPeer(room, remote.Id, pc, "", remote.Mute, remote.Role)
+	peer.relay = rl.origin
+	room.m[peer.uid] = peer
+	room.vacant.Store(false)
+	room.Unlock()
+
+	rp := &relayPeer{peer: peer, cid: remote.Track, tracks: remote.tracksKey(), location: location}
+	err = lockRunWithTimeout(func() error {
+		return pc.SetRemoteDescription(*answer)
+	}, peerTrackReadTimeout)
+	if err != nil {
+		rl.drop(remote.Id, rp)
+		return nil, err
+	}
+	return rp, nil
+}
+
+func (rl *relay) drop(uid string, rp *relayPeer) {
+	delete(rl.peers, uid)
+	err := rp.peer.CloseWithTimeout("")
+	logger.Printf("relay.drop(%s, %s, %s) => %v\n", rl.rid, rl.origin, uid, err)
+	rl.delete(rp.location)
+}
+
+func (p *relayRemote) tracksKey() string {
+	ids := make([]string, 0, len(p.Tracks))
+	for _, t := range p.Tracks {
+		ids = append(ids, t.Id)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+func (rl *relay) list() ([]*relayRemote, error) {
+	body, _ := json.Marshal(map[string]any{
+		"id":     uuid.Must(uuid.NewV4()).String(),
+		"method": "list",
+		"params": []any{rl.rid},
+	})
+	resp, err := rl.request("POST", rl.origin, "application/json", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		Data struct {
+			Peers []*relayRemote `json:"peers"`
+		} `json:"data"`
+		Error *Error `json:"error"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return nil, fmt.Errorf("status: %d %v", resp.StatusCode, err)
+	}
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	return res.Data.Peers, nil
+}
+
+// whep resolves the session location against the origin, to close the
+// session once the remote peer leaves
+func (rl *relay) whep(uid, offer string) (string, *webrtc.SessionDescription, error) {
+	resp, err := rl.request("POST", fmt.Sprintf("%s/whep/%s/%s", rl.origin, rl.rid, uid), whipContentTypeSDP, []byte(offer))
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, whipBodyLimit))
+	if err != nil {
+		return "", nil, err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return "", nil, fmt.Errorf("whep status: %d %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	answer := &webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: string(body)}
+	return rl.origin + resp.Header.Get("Location"), answer, nil
+}
+
+func (rl *relay) delete(location string) {
+	resp, err := rl.request("DELETE", location, "", nil)
+	if err != nil {
+		logger.Printf("relay.delete(%s) => %v\n", location, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// request refuses any URL outside the origin, e.g. a session location
+// crafted by the origin, so the token never leaves the allowed engines
+func (rl *relay) request(method, uri, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, uri, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	origin, err := url.Parse(rl.origin)
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Scheme != origin.Scheme || req.URL.Host != origin.Host || req.URL.User != nil {
+		return nil, fmt.Errorf("relay request %s outside origin %s", uri, rl.origin)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if len(rl.secret) > 0 {
+		token, err := relayToken(rl.secret, rl.rid)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return rl.client.Do(req)
+}
+
+// relayToken signs a short lived token for the origin, the engines of a
+// cascade must share the same HS256 auth secret
+func relayToken(secret []byte, rid string) (string, error) {
+	claims := &Claims{
+		Rid:         rid,
+		Permissions: []string{"list", "subscribe"},
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(relayTokenExpiry)),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
+}
@@ -0,0 +1,72 @@
+package engine
+
+import (
+	"fmt"
+)
+
+const (
+	peerRoleSpeaker   = "speaker"
+	peerRoleListener  = "listener"
+	peerRoleModerator = "moderator"
+)
+
+type actor struct {
+	uid  string
+	role string
+}
+
+func validateRole(role string) error {
+	switch role {
+	case peerRoleSpeaker, peerRoleListener, peerRoleModerator:
+		return nil
+	}
+	return buildError(ErrorInvalidParams, fmt.Errorf("invalid role %s", role))
+}
+
+// publishRole lets a token holder join with a lower role than granted,
+// e.g. as a listener, but never escalate it through the publish params
+func publishRole(claims *Claims, role string) (string, error) {
+	if role != "" {
+		if err := validateRole(role); err != nil {
+			return "", err
+		}
+	}
+	if claims == nil {
+		if role == "" {
+			role = peerRoleSpeaker
+		}
+		return role, nil
+	}
+	if role != peerRoleListener {
+		role = claims.role()
+	}
+	return role, nil
+}
+
+func (c *Claims) role() string {
+	if c.Role == "" {
+		return peerRoleSpeaker
+	}
+	return c.Role
+}
+
+func (c *Claims) actor() *actor {
+	return &actor{uid: c.Uid, role: c.role()}
+}
+
+func (a *actor) moderate(action, uid string) error {
+	if a.role == peerRoleModerator {
+		return nil
+	}
+	return buildError(ErrorModeratorRequired, fmt.Errorf("%s can not %s %s", a.uid, action, uid))
+}
+
+func (a *actor) canMute(target *Peer) error {
+	if target.role == peerRoleListener && target.listenOnly.Load() {
+		return buildError(ErrorListenerUnmute, fmt.Errorf("listener %s can not unmute", target.uid))
+	}
+	if a.role == peerRoleModerator || a.uid == target.uid {
+		return nil
+	}
+	return buildError(ErrorModeratorRequired, fmt.Errorf("%s can not mute %s", a.uid, target.uid))
+}
@@ -14,40 +14,116 @@ import (
 )
 
 type Router struct {
-	engine *Engine
+	engine  *Engine
+	viewers *vmap
 }
 
 func NewRouter(engine *Engine) *Router {
-	return &Router{engine: engine}
+	return &Router{engine: engine, viewers: engine.viewers}
 }
 
 func (r *Router) info() any {
 	r.engine.rooms.RLock()
 	defer r.engine.rooms.RUnlock()
 
-	return r.engine.state
+	if r.engine.state == nil {
+		return nil
+	}
+	state := *r.engine.state
+	state.Draining = r.engine.draining.Load()
+	return &state
 }
 
-func (r *Router) list(rid string) ([]map[string]any, error) {
-	room := r.engine.GetRoom(rid)
-	peers := room.PeersCopy()
+func (r *Router) list(rid string) ([]map[string]any, int, error) {
+	var listeners int
 	list := make([]map[string]any, 0)
+	room := r.engine.getRoom(rid)
+	if room == nil {
+		return list, listeners, nil
+	}
+	peers := room.PeersCopy()
 	for _, p := range peers {
 		cid := uuid.FromStringOrNil(p.cid)
 		if cid.String() == uuid.Nil.String() {
 			continue
 		}
+		if p.role == peerRoleListener {
+			listeners += 1
+			continue
+		}
+		tracks := make([]map[string]any, 0)
+		for _, t := range p.tracksCopy() {
+			tracks = append(tracks, map[string]any{
+				"id":   t.id,
+				"kind": t.kind.String(),
+			})
+		}
 		list = append(list, map[string]any{
-			"id":    p.uid,
-			"track": cid.String(),
-			"mute":  p.listenOnly,
+			"id":     p.uid,
+			"track":  cid.String(),
+			"tracks": tracks,
+			"level":  p.level(),
+			"mute":   p.listenOnly.Load(),
+			"role":   p.role,
+			"relay":  p.relay,
 		})
 	}
-	return list, nil
+	return list, listeners, nil
+}
+
+func (r *Router) speakers(rid string) []map[string]any {
+	room := r.engine.getRoom(rid)
+	if room == nil {
+		return make([]map[string]any, 0)
+	}
+	return room.speakers()
 }
 
-func (r *Router) mute(rid, uid string) map[string]any {
+func (r *Router) lastN(rid string, n int) (map[string]any, error) {
+	room := r.engine.GetRoom(rid)
+	err := room.setLastN(n)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"rid": rid, "n": n}, nil
+}
+
+func (r *Router) slots(rid, uid, cid string) ([]map[string]any, error) {
+	room, peer, err := r.engine.GetPeer(rid, uid, cid)
+	if err != nil {
+		return nil, err
+	}
+	return room.slotsOf(peer.cid), nil
+}
+
+func (r *Router) record(rid string, enable bool) (map[string]any, error) {
+	if err := validateId(rid); err != nil {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid rid format %s %s", rid, err.Error()))
+	}
+	if !enable {
+		room := r.engine.getRoom(rid)
+		if room == nil {
+			return map[string]any{}, nil
+		}
+		rec := room.stopRecording()
+		if rec == nil {
+			return map[string]any{}, nil
+		}
+		return rec.info(), nil
+	}
 	room := r.engine.GetRoom(rid)
+	rec, err := room.startRecording(r.engine.Recording, r.engine.Mixed)
+	if err != nil {
+		return nil, err
+	}
+	return rec.info(), nil
+}
+
+func (r *Router) mute(rid, uid string, by *actor) (map[string]any, error) {
+	room := r.engine.getRoom(rid)
+	if room == nil {
+		return nil, nil
+	}
 	peers := room.PeersCopy()
 	for _, p := range peers {
 		if p.uid != uid {
@@ -57,26 +133,49 @@ func (r *Router) mute(rid, uid string) map[string]any {
 		if cid.String() == uuid.Nil.String() {
 			continue
 		}
-		p.listenOnly = !p.listenOnly
+		if err := by.canMute(p); err != nil {
+			return nil, err
+		}
+		muted := !p.listenOnly.Load()
+		p.listenOnly.Store(muted)
+		if muted {
+			room.webhook.peer(p, webhookEventMute, "")
+		} else {
+			room.webhook.peer(p, webhookEventUnmute, "")
+		}
 		return map[string]any{
 			"id":    p.uid,
 			"track": cid.String(),
-			"mute":  p.listenOnly,
-		}
+			"mute":  muted,
+		}, nil
 	}
-	return nil
+	return nil, nil
 }
 
-func (r *Router) create(rid, uid, callback string, listenOnly bool, offer webrtc.SessionDescription) (*Peer, error) {
+func (r *Router) actor(rid, uid, cid string) (*actor, error) {
+	_, peer, err := r.engine.GetPeer(rid, uid, cid)
+	if err != nil {
+		return nil, err
+	}
+	return &actor{uid: peer.uid, role: peer.role}, nil
+}
+
+func (r *Router) newPeerConnection() (*webrtc.PeerConnection, error) {
+	return r.buildPeerConnection(true)
+}
+
+// buildPeerConnection builds the relay connections without lite, because
+// the origin engine is a lite agent
+func (r *Router) buildPeerConnection(lite bool) (*webrtc.PeerConnection, error) {
 	se := webrtc.SettingEngine{}
-	se.SetLite(true)
+	se.SetLite(lite)
 	se.EnableSCTPZeroChecksum(true)
 	se.SetInterfaceFilter(func(in string) bool { return in == r.engine.Interface })
 	se.SetNAT1To1IPs([]string{r.engine.IP}, webrtc.ICECandidateTypeHost)
 	se.SetICETimeouts(10*time.Second, 20*time.Second, 2*time.Second)
 	se.SetDTLSInsecureSkipHelloVerify(true)
 	se.SetReceiveMTU(8192)
-	err := se.SetEphemeralUDPPortRange(r.engine.PortMin, r.engine.PortMax)
+	err := r.engine.configureICEMux(&se)
 	if err != nil {
 		return nil, err
 	}
@@ -110,6 +209,16 @@ func (r *Router) create(rid, uid, callback string, listenOnly bool, offer webrtc
 	if err != nil {
 		return nil, err
 	}
+	err = me.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: audioLevelExtensionURI}, webrtc.RTPCodecTypeAudio)
+	if err != nil {
+		return nil, err
+	}
+	for _, codec := range videoCodecs() {
+		err = me.RegisterCodec(codec, webrtc.RTPCodecTypeVideo)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	ir := &interceptor.Registry{}
 	err = webrtc.RegisterDefaultInterceptors(me, ir)
@@ -127,28 +236,86 @@ func (r *Router) create(rid, uid, callback string, listenOnly bool, offer webrtc
 	if err != nil {
 		return nil, buildError(ErrorServerNewPeerConnection, err)
 	}
+	return pc, nil
+}
 
+func (r *Router) create(room *pmap, uid, callback string, listenOnly bool, role string, sig signaler, offer webrtc.SessionDescription) (*Peer, error) {
+	pc, err := r.newPeerConnection()
+	if err != nil {
+		return nil, err
+	}
+
+	peer := BuildPeer(room, uid, pc, callback, listenOnly, role)
+	if sig != nil {
+		peer.signaler = sig
+		pc.OnICECandidate(peer.trickleCandidate)
+	}
 	err = pc.SetRemoteDescription(offer)
 	if err != nil {
-		pc.Close()
+		_ = peer.close("")
 		return nil, buildError(ErrorServerSetRemoteOffer, err)
 	}
 	answer, err := pc.CreateAnswer(nil)
 	if err != nil {
-		pc.Close()
+		_ = peer.close("")
 		return nil, buildError(ErrorServerCreateAnswer, err)
 	}
-	err = setLocalDescription(pc, answer)
+	if sig != nil {
+		err = pc.SetLocalDescription(answer)
+	} else {
+		err = setLocalDescription(pc, answer)
+	}
 	if err != nil {
-		pc.Close()
+		_ = peer.close("")
 		return nil, buildError(ErrorServerSetLocalAnswer, err)
 	}
-
-	peer := BuildPeer(rid, uid, pc, callback, listenOnly)
 	return peer, nil
 }
 
-func (r *Router) publish(rid, uid string, jsep string, limit int, callback string, listenOnly bool) (string, *webrtc.SessionDescription, error) {
+func videoCodecs() []webrtc.RTPCodecParameters {
+	feedback := []webrtc.RTCPFeedback{
+		{Type: "goog-remb"},
+		{Type: "ccm", Parameter: "fir"},
+		{Type: "nack"},
+		{Type: "nack", Parameter: "pli"},
+	}
+	return []webrtc.RTPCodecParameters{{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:     webrtc.MimeTypeVP8,
+			ClockRate:    90000,
+			RTCPFeedback: feedback,
+		},
+		PayloadType: 96,
+	}, {
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:     webrtc.MimeTypeVP9,
+			ClockRate:    90000,
+			SDPFmtpLine:  "profile-id=0",
+			RTCPFeedback: feedback,
+		},
+		PayloadType: 98,
+	}, {
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:     webrtc.MimeTypeH264,
+			ClockRate:    90000,
+			SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+			RTCPFeedback: feedback,
+		},
+		PayloadType: 102,
+	}, {
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:     webrtc.MimeTypeAV1,
+			ClockRate:    90000,
+			RTCPFeedback: feedback,
+		},
+		PayloadType: 45,
+	}}
+}
+
+func (r *Router) publish(rid, uid string, jsep string, limit int, callback string, listenOnly bool, role string, sig signaler) (string, *webrtc.SessionDescription, error) {
+	if r.engine.draining.Load() {
+		return "", nil, buildError(ErrorServerDraining, fmt.Errorf("engine draining"))
+	}
 	if err := validateId(rid); err != nil {
 		return "", nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid rid format %s %s", rid, err.Error()))
 	}
@@ -175,7 +342,7 @@ func (r *Router) publish(rid, uid string, jsep string, limit int, callback strin
 		peers := room.PeersCopy()
 		for i, p := range peers {
 			cid := uuid.FromStringOrNil(p.cid)
-			if cid.String() == uuid.Nil.String() || uid == i {
+			if cid.String() == uuid.Nil.String() || uid == i || p.role == peerRoleListener {
 				continue
 			}
 			limit--
@@ -188,9 +355,13 @@ func (r *Router) publish(rid, uid string, jsep string, limit int, callback strin
 	room.Lock()
 	defer room.Unlock()
 
+	if until := room.bans[uid]; time.Now().Before(until) {
+		return "", nil, buildError(ErrorPeerBanned, fmt.Errorf("peer %s banned from %s until %s", uid, rid, until.Format(time.RFC3339)))
+	}
+
 	var peer *Peer
 	err = lockRunWithTimeout(func() error {
-		pub, err := r.create(rid, uid, callback, listenOnly, offer)
+		pub, err := r.create(room, uid, callback, listenOnly || role == peerRoleListener, role, sig, offer)
 		peer = pub
 		return err
 	}, peerTrackConnectionTimeout)
@@ -200,15 +371,20 @@ func (r *Router) publish(rid, uid string, jsep string, limit int, callback strin
 
 	old := room.m[peer.uid]
 	if old != nil {
-		_ = old.CloseWithTimeout()
+		_ = old.CloseWithTimeout(leaveReasonReplaced)
 	}
 	room.m[peer.uid] = peer
+	room.vacant.Store(false)
+	room.webhook.peer(peer, webhookEventJoin, "")
 	return peer.cid, peer.pc.LocalDescription(), nil
 }
 
+func (r *Router) listen(rid, uid string, jsep string, sig signaler) (string, *webrtc.SessionDescription, error) {
+	return r.publish(rid, uid, jsep, 0, "", true, peerRoleListener, sig)
+}
+
 func (r *Router) restart(rid, uid, cid string, jsep string) (*webrtc.SessionDescription, error) {
-	room := r.engine.GetRoom(rid)
-	peer, err := room.GetPeer(uid, cid)
+	_, peer, err := r.engine.GetPeer(rid, uid, cid)
 	if err != nil {
 		return nil, err
 	}
@@ -248,21 +424,21 @@ func (r *Router) restart(rid, uid, cid string, jsep string) (*webrtc.SessionDesc
 
 	if err != nil {
 		_ = lockRunWithTimeout(func() error {
-			return peer.close()
+			return peer.close(leaveReasonError)
 		}, peerTrackReadTimeout)
 		return nil, err
 	}
+	peer.room.webhook.peer(peer, webhookEventICERestart, "")
 	return peer.pc.LocalDescription(), nil
 }
 
 func (r *Router) end(rid, uid, cid string) error {
-	room := r.engine.GetRoom(rid)
-	peer, err := room.GetPeer(uid, cid)
+	_, peer, err := r.engine.GetPeer(rid, uid, cid)
 	if err != nil {
 		return err
 	}
 
-	return peer.CloseWithTimeout()
+	return peer.CloseWithTimeout(leaveReasonEnd)
 }
 
 func (r *Router) trickle(rid, uid, cid string, candi string) error {
@@ -275,8 +451,7 @@ func (r *Router) trickle(rid, uid, cid string, candi string) error {
 		return nil
 	}
 
-	room := r.engine.GetRoom(rid)
-	peer, err := room.GetPeer(uid, cid)
+	_, peer, err := r.engine.GetPeer(rid, uid, cid)
 	if err != nil {
 		return err
 	}
@@ -288,8 +463,11 @@ func (r *Router) trickle(rid, uid, cid string, candi string) error {
 	}, peerTrackReadTimeout)
 }
 
-func (r *Router) subscribe(rid, uid, cid string) (*webrtc.SessionDescription, error) {
-	room := r.engine.GetRoom(rid)
+func (r *Router) subscribe(rid, uid, cid string, mixed bool) (*webrtc.SessionDescription, error) {
+	room := r.engine.getRoom(rid)
+	if room == nil {
+		return nil, buildError(ErrorPeerNotFound, fmt.Errorf("peer %s not found in %s", uid, rid))
+	}
 	room.Lock()
 	defer room.Unlock()
 
@@ -299,10 +477,10 @@ func (r *Router) subscribe(rid, uid, cid string) (*webrtc.SessionDescription, er
 	}
 
 	err = lockRunWithTimeout(func() error {
-		err := peer.doSubscribe(room.m)
+		_, err := peer.doSubscribe(room, mixed)
 		logger.Printf("peer.doSubscribe(%s, %s, %s) => %v", rid, uid, cid, err)
 		if err != nil {
-			_ = peer.close()
+			_ = peer.close(leaveReasonError)
 			return err
 		}
 		return nil
@@ -314,18 +492,43 @@ func (r *Router) subscribe(rid, uid, cid string) (*webrtc.SessionDescription, er
 	return peer.pc.LocalDescription(), nil
 }
 
-func (peer *Peer) doSubscribe(peers map[string]*Peer) error {
+func (peer *Peer) doSubscribe(room *pmap, mixed bool) (bool, error) {
 	peer.Lock()
 	defer peer.Unlock()
 
-	return lockRunWithTimeout(func() error {
-		var renegotiate bool
-		for _, pub := range peers {
+	var renegotiated bool
+	err := lockRunWithTimeout(func() error {
+		peer.mixed = mixed
+		lastN := room.lastN.size()
+		if mixed {
+			lastN = 0
+		}
+		renegotiate, err := peer.connectSlots(room.lastN, lastN)
+		if err != nil {
+			return err
+		}
+		res, err := peer.connectMixer(room.mixer)
+		if err != nil {
+			return err
+		}
+		renegotiate = renegotiate || res
+		for id, old := range peer.publishers {
+			if room.m[old.uid] != nil {
+				continue
+			}
+			err := peer.pc.RemoveTrack(old.rtp)
+			if err != nil {
+				return fmt.Errorf("pc.RemoveTrack(%s, %s, %s) => %v", old.uid, peer.id(), id, err)
+			}
+			delete(peer.publishers, id)
+			renegotiate = true
+		}
+		for _, pub := range room.m {
 			if pub.uid == peer.uid {
 				continue
 			}
 
-			res, err := peer.connectPublisher(pub)
+			res, err := peer.connectPublisher(pub, lastN == 0 && !mixed)
 			if err != nil {
 				return err
 			}
@@ -340,36 +543,51 @@ func (peer *Peer) doSubscribe(peers map[string]*Peer) error {
 			if err != nil {
 				return buildError(ErrorServerSetLocalOffer, err)
 			}
+			renegotiated = true
 		}
 		return nil
 	}, peerTrackReadTimeout)
+	return renegotiated, err
 }
 
-func (sub *Peer) connectPublisher(pub *Peer) (bool, error) {
+func (sub *Peer) connectPublisher(pub *Peer, audio bool) (bool, error) {
 	pub.RLock()
 	defer pub.RUnlock()
 
 	var renegotiate bool
+	offstage := pub.role == peerRoleListener
 	err := lockRunWithTimeout(func() error {
-		old := sub.publishers[pub.uid]
-		if old != nil && (pub.track == nil || old.id != pub.cid) {
+		for id, old := range sub.publishers {
+			if old.uid != pub.uid {
+				continue
+			}
+			if t := pub.tracks[id]; t != nil && !offstage && (audio || t.kind != webrtc.RTPCodecTypeAudio) {
+				continue
+			}
 			err := sub.pc.RemoveTrack(old.rtp)
 			if err != nil {
-				return fmt.Errorf("pc.RemoveTrack(%s, %s) => %v", pub.id(), sub.id(), err)
+				return fmt.Errorf("pc.RemoveTrack(%s, %s, %s) => %v", pub.id(), sub.id(), id, err)
 			}
-			delete(sub.publishers, pub.uid)
+			delete(sub.publishers, id)
 			renegotiate = true
 		}
-		if pub.track != nil && (old == nil || old.id != pub.cid) {
-			sender, err := sub.pc.AddTrack(pub.track)
-			logger.Printf("pc.AddTrack(%s, %s) => %v %v", sub.id(), pub.id(), sender, err)
+		for id, track := range pub.tracks {
+			if offstage || sub.publishers[id] != nil {
+				continue
+			}
+			if !audio && track.kind == webrtc.RTPCodecTypeAudio {
+				continue
+			}
+			sender, err := sub.pc.AddTrack(track.local)
+			logger.Printf("pc.AddTrack(%s, %s, %s) => %v %v", sub.id(), pub.id(), id, sender, err)
 			if err != nil {
-				return fmt.Errorf("pc.AddTrack(%s, %s) => %v", sub.id(), pub.id(), err)
+				return fmt.Errorf("pc.AddTrack(%s, %s, %s) => %v", sub.id(), pub.id(), id, err)
 			}
-			if id := sender.Track().ID(); id != pub.cid {
-				return fmt.Errorf("malformed peer and track id %s %s", pub.cid, id)
+			if tid := sender.Track().ID(); tid != id {
+				return fmt.Errorf("malformed peer and track id %s %s", id, tid)
 			}
-			sub.publishers[pub.uid] = &Sender{id: pub.cid, rtp: sender}
+			sub.publishers[id] = &Sender{id: id, uid: pub.uid, rtp: sender}
+			go pub.readSenderRTCP(track, sender)
 			renegotiate = true
 		}
 		return nil
@@ -393,8 +611,7 @@ func (r *Router) answer(rid, uid, cid string, jsep string) error {
 		return buildError(ErrorInvalidSDP, err)
 	}
 
-	room := r.engine.GetRoom(rid)
-	peer, err := room.GetPeer(uid, cid)
+	room, peer, err := r.engine.GetPeer(rid, uid, cid)
 	if err != nil {
 		return err
 	}
@@ -411,6 +628,9 @@ func (r *Router) answer(rid, uid, cid string, jsep string) error {
 		if err != nil {
 			return buildError(ErrorServerSetRemoteAnswer, err)
 		}
+		if peer.signaler != nil {
+			room.renegotiate()
+		}
 		return nil
 	}, peerTrackReadTimeout)
 }
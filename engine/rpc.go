@@ -1,6 +1,7 @@
 package engine
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -16,9 +17,14 @@ import (
 	"github.com/unrolled/render"
 )
 
+const (
+	rpcShutdownTimeout = 10 * time.Second
+)
+
 type R struct {
 	router *Router
 	conf   *Configuration
+	auth   *authenticator
 }
 
 type Call struct {
@@ -55,6 +61,7 @@ func (r *Render) RenderData(data any) {
 	}
 	logger.Printf("RPC.handle(id: %s, method: %s, time: %f) OK\n",
 		r.call.Id, r.call.Method, time.Since(r.startAt).Seconds())
+	observeRPC(r.call.Method, r.startAt, nil)
 }
 
 func (r *Render) RenderError(err error) {
@@ -68,12 +75,17 @@ func (r *Render) RenderError(err error) {
 	}
 	logger.Printf("RPC.handle(id: %s, method: %s, time: %f) ERROR %s\n",
 		r.call.Id, r.call.Method, time.Since(r.startAt).Seconds(), err.Error())
+	observeRPC(r.call.Method, r.startAt, err)
 }
 
 func (impl *R) root(w http.ResponseWriter, r *http.Request, _ map[string]string) {
-	info := impl.info()
 	renderer := NewRender(w, &Call{Id: uuid.Must(uuid.NewV4()).String(), Method: "root"})
-	renderer.RenderData(info)
+	_, err := impl.authorize(bearerToken(r), "info", nil)
+	if err != nil {
+		renderer.RenderError(err)
+		return
+	}
+	renderer.RenderData(impl.info())
 }
 
 func (impl *R) handle(w http.ResponseWriter, r *http.Request, _ map[string]string) {
@@ -86,78 +98,127 @@ func (impl *R) handle(w http.ResponseWriter, r *http.Request, _ map[string]strin
 	}
 	renderer := NewRender(w, &call)
 	logger.Printf("RPC.handle(id: %s, method: %s, params: %v)\n", call.Id, call.Method, call.Params)
+	claims, err := impl.authorize(bearerToken(r), call.Method, call.Params)
+	if err != nil {
+		renderer.RenderError(err)
+		return
+	}
+	data, err := impl.dispatch(&call, claims, nil)
+	if err != nil {
+		renderer.RenderError(err)
+	} else {
+		renderer.RenderData(data)
+	}
+}
+
+func (impl *R) dispatch(call *Call, claims *Claims, sig signaler) (any, error) {
 	switch call.Method {
 	case "turn":
-		servers, err := impl.turn(call.Params)
-		if err != nil {
-			renderer.RenderError(err)
-		} else {
-			renderer.RenderData(servers)
-		}
+		return impl.turn(call.Params)
 	case "info":
-		info := impl.info()
-		renderer.RenderData(info)
+		return impl.info(), nil
 	case "list":
-		peers, err := impl.list(call.Params)
+		peers, listeners, err := impl.list(call.Params)
 		if err != nil {
-			renderer.RenderError(err)
-		} else {
-			renderer.RenderData(map[string]any{"peers": peers})
+			return nil, err
+		}
+		return map[string]any{"peers": peers, "listeners": listeners}, nil
+	case "speakers":
+		speakers, err := impl.speakers(call.Params)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"speakers": speakers}, nil
+	case "stats":
+		stats, err := impl.stats(call.Params)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"stats": stats}, nil
+	case "lastn":
+		room, err := impl.lastN(call.Params)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"room": room}, nil
+	case "slots":
+		slots, err := impl.slots(call.Params)
+		if err != nil {
+			return nil, err
 		}
+		return map[string]any{"slots": slots}, nil
+	case "record":
+		recording, err := impl.record(call.Params)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"recording": recording}, nil
 	case "mute":
-		peer, err := impl.mute(call.Params)
+		peer, err := impl.mute(call.Params, claims)
 		if err != nil {
-			renderer.RenderError(err)
-		} else {
-			renderer.RenderData(map[string]any{"peer": peer})
+			return nil, err
+		}
+		return map[string]any{"peer": peer}, nil
+	case "raise", "lower":
+		hands, err := impl.hand(call.Params, call.Method == "raise")
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"hands": hands}, nil
+	case "hands":
+		hands, err := impl.hands(call.Params)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"hands": hands}, nil
+	case "promote", "demote", "kick", "ban":
+		peer, err := impl.moderate(call.Params, claims, call.Method)
+		if err != nil {
+			return nil, err
 		}
+		return map[string]any{"peer": peer}, nil
+	case "relay", "unrelay":
+		relay, err := impl.relay(call.Params, call.Method == "relay")
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"relay": relay}, nil
 	case "publish":
-		cid, answer, err := impl.publish(call.Params)
+		cid, answer, err := impl.publish(call.Params, claims, sig)
 		if err != nil {
-			renderer.RenderError(err)
-		} else {
-			jsep, _ := json.Marshal(answer)
-			renderer.RenderData(map[string]any{"track": cid, "sdp": answer, "jsep": string(jsep)})
+			return nil, err
 		}
+		jsep, _ := json.Marshal(answer)
+		return map[string]any{"track": cid, "sdp": answer, "jsep": string(jsep)}, nil
+	case "listen":
+		cid, answer, err := impl.listen(call.Params, sig)
+		if err != nil {
+			return nil, err
+		}
+		jsep, _ := json.Marshal(answer)
+		return map[string]any{"track": cid, "sdp": answer, "jsep": string(jsep)}, nil
 	case "restart":
 		answer, err := impl.restart(call.Params)
 		if err != nil {
-			renderer.RenderError(err)
-		} else {
-			jsep, _ := json.Marshal(answer)
-			renderer.RenderData(map[string]any{"jsep": string(jsep)})
+			return nil, err
 		}
+		jsep, _ := json.Marshal(answer)
+		return map[string]any{"jsep": string(jsep)}, nil
 	case "end":
-		err := impl.end(call.Params)
-		if err != nil {
-			renderer.RenderError(err)
-		} else {
-			renderer.RenderData(map[string]string{})
-		}
+		return map[string]string{}, impl.end(call.Params)
 	case "trickle":
-		err := impl.trickle(call.Params)
-		if err != nil {
-			renderer.RenderError(err)
-		} else {
-			renderer.RenderData(map[string]string{})
-		}
+		return map[string]string{}, impl.trickle(call.Params)
 	case "subscribe":
 		offer, err := impl.subscribe(call.Params)
 		if err != nil {
-			renderer.RenderError(err)
-		} else {
-			jsep, _ := json.Marshal(offer)
-			renderer.RenderData(map[string]any{"type": offer.Type, "sdp": offer.SDP, "jsep": string(jsep)})
+			return nil, err
 		}
+		jsep, _ := json.Marshal(offer)
+		return map[string]any{"type": offer.Type, "sdp": offer.SDP, "jsep": string(jsep)}, nil
 	case "answer":
-		err := impl.answer(call.Params)
-		if err != nil {
-			renderer.RenderError(err)
-		} else {
-			renderer.RenderData(map[string]string{})
-		}
+		return map[string]string{}, impl.answer(call.Params)
 	default:
-		renderer.RenderError(fmt.Errorf("invalid method %s", call.Method))
+		return nil, fmt.Errorf("invalid method %s", call.Method)
 	}
 }
 
@@ -176,7 +237,18 @@ func (r *R) info() any {
 	return r.router.info()
 }
 
-func (r *R) list(params []any) ([]map[string]any, error) {
+func (r *R) list(params []any) ([]map[string]any, int, error) {
+	if len(params) != 1 {
+		return nil, 0, buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
+	}
+	rid, ok := params[0].(string)
+	if !ok {
+		return nil, 0, buildError(ErrorInvalidParams, fmt.Errorf("invalid rid type %s", params[0]))
+	}
+	return r.router.list(rid)
+}
+
+func (r *R) speakers(params []any) ([]map[string]any, error) {
 	if len(params) != 1 {
 		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
 	}
@@ -184,10 +256,10 @@ func (r *R) list(params []any) ([]map[string]any, error) {
 	if !ok {
 		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid rid type %s", params[0]))
 	}
-	return r.router.list(rid)
+	return r.router.speakers(rid), nil
 }
 
-func (r *R) mute(params []any) (map[string]any, error) {
+func (r *R) stats(params []any) (map[string]any, error) {
 	if len(params) != 2 {
 		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
 	}
@@ -199,14 +271,149 @@ func (r *R) mute(params []any) (map[string]any, error) {
 	if !ok {
 		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid uid type %s", params[1]))
 	}
-	peer := r.router.mute(rid, uid)
+	return r.router.stats(rid, uid)
+}
+
+func (r *R) lastN(params []any) (map[string]any, error) {
+	if len(params) != 2 {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
+	}
+	rid, ok := params[0].(string)
+	if !ok {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid rid type %s", params[0]))
+	}
+	n, err := strconv.ParseInt(fmt.Sprint(params[1]), 10, 32)
+	if err != nil {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid n type %v %v", params[1], err))
+	}
+	return r.router.lastN(rid, int(n))
+}
+
+func (r *R) slots(params []any) ([]map[string]any, error) {
+	if len(params) != 3 {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
+	}
+	ids, err := r.parseId(params)
+	if err != nil {
+		return nil, buildError(ErrorInvalidParams, err)
+	}
+	return r.router.slots(ids[0], ids[1], ids[2])
+}
+
+func (r *R) record(params []any) (map[string]any, error) {
+	if len(params) != 1 && len(params) != 2 {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
+	}
+	rid, ok := params[0].(string)
+	if !ok {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid rid type %s", params[0]))
+	}
+	enable := true
+	if len(params) == 2 {
+		b, err := strconv.ParseBool(fmt.Sprint(params[1]))
+		if err != nil {
+			return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid enable type %v %v", params[1], err))
+		}
+		enable = b
+	}
+	return r.router.record(rid, enable)
+}
+
+func (r *R) mute(params []any, claims *Claims) (map[string]any, error) {
+	if len(params) != 2 && len(params) != 4 {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
+	}
+	rid, ok := params[0].(string)
+	if !ok {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid rid type %s", params[0]))
+	}
+	uid, ok := params[1].(string)
+	if !ok {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid uid type %s", params[1]))
+	}
+	by, err := r.parseActor(rid, params, claims)
+	if err != nil {
+		return nil, err
+	}
+	peer, err := r.router.mute(rid, uid, by)
+	if err != nil {
+		return nil, err
+	}
 	if peer == nil {
 		return nil, buildError(http.StatusNotFound, fmt.Errorf("peer not found %s", params[1]))
 	}
 	return peer, nil
 }
 
-func (r *R) publish(params []any) (string, *webrtc.SessionDescription, error) {
+func (r *R) hand(params []any, raise bool) ([]map[string]any, error) {
+	if len(params) != 3 {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
+	}
+	ids, err := r.parseId(params)
+	if err != nil {
+		return nil, buildError(ErrorInvalidParams, err)
+	}
+	return r.router.hand(ids[0], ids[1], ids[2], raise)
+}
+
+func (r *R) hands(params []any) ([]map[string]any, error) {
+	if len(params) != 1 {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
+	}
+	rid, ok := params[0].(string)
+	if !ok {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid rid type %s", params[0]))
+	}
+	return r.router.hands(rid), nil
+}
+
+func (r *R) moderate(params []any, claims *Claims, method string) (map[string]any, error) {
+	if len(params) != 2 && len(params) != 4 {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
+	}
+	rid, ok := params[0].(string)
+	if !ok {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid rid type %s", params[0]))
+	}
+	uid, ok := params[1].(string)
+	if !ok {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid uid type %s", params[1]))
+	}
+	by, err := r.parseActor(rid, params, claims)
+	if err != nil {
+		return nil, err
+	}
+	switch method {
+	case "promote":
+		return r.router.promote(rid, uid, by)
+	case "demote":
+		return r.router.demote(rid, uid, by)
+	case "kick":
+		return r.router.kick(rid, uid, by)
+	default:
+		return r.router.ban(rid, uid, by)
+	}
+}
+
+func (r *R) relay(params []any, start bool) (map[string]any, error) {
+	if len(params) != 2 {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
+	}
+	rid, ok := params[0].(string)
+	if !ok {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid rid type %s", params[0]))
+	}
+	origin, ok := params[1].(string)
+	if !ok {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid origin type %s", params[1]))
+	}
+	if !start {
+		return r.router.unrelay(rid, origin)
+	}
+	return r.router.relay(rid, origin, []byte(r.conf.Auth.Secret))
+}
+
+func (r *R) publish(params []any, claims *Claims, sig signaler) (string, *webrtc.SessionDescription, error) {
 	if len(params) < 3 {
 		return "", nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
 	}
@@ -224,7 +431,7 @@ func (r *R) publish(params []any) (string, *webrtc.SessionDescription, error) {
 	}
 	var limit int
 	var callback string
-	if len(params) == 5 {
+	if len(params) >= 5 {
 		i, err := strconv.ParseInt(fmt.Sprint(params[3]), 10, 32)
 		if err != nil {
 			return "", nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid limit type %v %v", params[3], err))
@@ -240,10 +447,40 @@ func (r *R) publish(params []any) (string, *webrtc.SessionDescription, error) {
 		callback = cbk
 	}
 	var listenOnly bool
-	if len(params) == 6 {
+	if len(params) >= 6 {
 		listenOnly, _ = strconv.ParseBool(fmt.Sprint(params[5]))
 	}
-	return r.router.publish(rid, uid, sdp, limit, callback, listenOnly)
+	var role string
+	if len(params) == 7 {
+		role, ok = params[6].(string)
+		if !ok {
+			return "", nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid role type %v", params[6]))
+		}
+	}
+	role, err := publishRole(claims, role)
+	if err != nil {
+		return "", nil, err
+	}
+	return r.router.publish(rid, uid, sdp, limit, callback, listenOnly, role, sig)
+}
+
+func (r *R) listen(params []any, sig signaler) (string, *webrtc.SessionDescription, error) {
+	if len(params) != 3 {
+		return "", nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
+	}
+	rid, ok := params[0].(string)
+	if !ok {
+		return "", nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid rid type %v", params[0]))
+	}
+	uid, ok := params[1].(string)
+	if !ok {
+		return "", nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid uid type %v", params[1]))
+	}
+	sdp, ok := params[2].(string)
+	if !ok {
+		return "", nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid sdp type %v", params[2]))
+	}
+	return r.router.listen(rid, uid, sdp, sig)
 }
 
 func (r *R) restart(params []any) (*webrtc.SessionDescription, error) {
@@ -288,14 +525,18 @@ func (r *R) trickle(params []any) error {
 }
 
 func (r *R) subscribe(params []any) (*webrtc.SessionDescription, error) {
-	if len(params) != 3 {
+	if len(params) != 3 && len(params) != 4 {
 		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
 	}
 	ids, err := r.parseId(params)
 	if err != nil {
 		return nil, buildError(ErrorInvalidParams, err)
 	}
-	return r.router.subscribe(ids[0], ids[1], ids[2])
+	var mixed bool
+	if len(params) == 4 {
+		mixed, _ = strconv.ParseBool(fmt.Sprint(params[3]))
+	}
+	return r.router.subscribe(ids[0], ids[1], ids[2], mixed)
 }
 
 func (r *R) answer(params []any) error {
@@ -313,6 +554,22 @@ func (r *R) answer(params []any) error {
 	return r.router.answer(ids[0], ids[1], ids[2], sdp)
 }
 
+// parseActor finds who makes a moderation call, from the token or the
+// actor uid and cid params, which are required without a token
+func (r *R) parseActor(rid string, params []any, claims *Claims) (*actor, error) {
+	if claims != nil {
+		return claims.actor(), nil
+	}
+	if len(params) != 4 {
+		return nil, buildError(ErrorModeratorRequired, fmt.Errorf("%s requires the actor uid and cid", rid))
+	}
+	ids, err := r.parseId([]any{rid, params[2], params[3]})
+	if err != nil {
+		return nil, buildError(ErrorInvalidParams, err)
+	}
+	return r.router.actor(ids[0], ids[1], ids[2])
+}
+
 func (r *R) parseId(params []any) ([]string, error) {
 	rid, ok := params[0].(string)
 	if !ok {
@@ -351,7 +608,8 @@ func handleCORS(handler http.Handler) http.Handler {
 		}
 		w.Header().Set("Access-Control-Allow-Origin", origin)
 		w.Header().Add("Access-Control-Allow-Headers", "Content-Type,Authorization,Mixin-Conversation-ID")
-		w.Header().Set("Access-Control-Allow-Methods", "OPTIONS,GET,POST,DELETE")
+		w.Header().Set("Access-Control-Allow-Methods", "OPTIONS,GET,POST,PATCH,DELETE")
+		w.Header().Set("Access-Control-Expose-Headers", "Location")
 		w.Header().Set("Access-Control-Max-Age", "600")
 		if r.Method == "OPTIONS" {
 			renderJSON(w, http.StatusOK, map[string]any{})
@@ -368,12 +626,31 @@ func renderJSON(w http.ResponseWriter, status int, data any) {
 	}
 }
 
-func ServeRPC(engine *Engine, conf *Configuration) error {
+// ServeRPC shuts the server down gracefully once the context is done, the
+// hijacked WebSocket connections are left to the peers closed by the drain
+func ServeRPC(ctx context.Context, engine *Engine, conf *Configuration) error {
 	logger.Printf("ServeRPC(:%d)\n", conf.RPC.Port)
-	impl := &R{router: NewRouter(engine), conf: conf}
+	auth, err := buildAuthenticator(conf)
+	if err != nil {
+		return err
+	}
+	impl := &R{router: NewRouter(engine), conf: conf, auth: auth}
+	metrics := metricsHandler(engine)
 	router := httptreemux.New()
 	router.GET("/", impl.root)
+	router.GET("/healthz", impl.healthz)
+	router.GET("/readyz", impl.readyz)
+	router.GET("/metrics", func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+		metrics.ServeHTTP(w, r)
+	})
 	router.POST("/", impl.handle)
+	router.GET("/ws", impl.socket)
+	router.POST("/whip/:rid/:uid", impl.whip)
+	router.PATCH("/whip/:rid/:uid/:cid", impl.whipPatch)
+	router.DELETE("/whip/:rid/:uid/:cid", impl.whipDelete)
+	router.POST("/whep/:rid/:uid", impl.whep)
+	router.PATCH("/whep/:rid/:uid/:sid", impl.whepPatch)
+	router.DELETE("/whep/:rid/:uid/:sid", impl.whepDelete)
 	registerHandlers(router)
 	handler := handleCORS(router)
 	handler = handlers.ProxyHeaders(handler)
@@ -385,5 +662,18 @@ func ServeRPC(engine *Engine, conf *Configuration) error {
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  120 * time.Second,
 	}
-	return server.ListenAndServe()
+	shutdown := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), rpcShutdownTimeout)
+		defer cancel()
+		shutdown <- server.Shutdown(sctx)
+	}()
+	err = server.ListenAndServe()
+	if err != http.ErrServerClosed {
+		return err
+	}
+	err = <-shutdown
+	logger.Printf("ServeRPC(:%d) shutdown %v\n", conf.RPC.Port, err)
+	return err
 }
@@ -0,0 +1,36 @@
+package engine
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseActor(t *testing.T) {
+	r := &R{}
+	rid := "room"
+
+	by, err := r.parseActor(rid, []any{rid, "uid"}, nil)
+	var e Error
+	if by != nil || !errors.As(err, &e) || e.Code != ErrorModeratorRequired {
+		t.Fatalf("parseActor(mute) => %v %v", by, err)
+	}
+
+	claims := &Claims{Uid: "mod", Role: peerRoleModerator}
+	by, err = r.parseActor(rid, []any{rid, "uid"}, claims)
+	if err != nil || by.uid != "mod" || by.role != peerRoleModerator {
+		t.Fatalf("parseActor(claims) => %v %v", by, err)
+	}
+	if err := by.moderate("kick", "uid"); err != nil {
+		t.Fatalf("moderator kick => %v", err)
+	}
+	by = (&Claims{Uid: "spk"}).actor()
+	if err := by.moderate("ban", "uid"); !errors.As(err, &e) || e.Code != ErrorModeratorRequired {
+		t.Fatalf("speaker ban => %v", err)
+	}
+	if err := by.canMute(&Peer{uid: "spk", role: peerRoleSpeaker}); err != nil {
+		t.Fatalf("speaker mute itself => %v", err)
+	}
+	if err := by.canMute(&Peer{uid: "uid", role: peerRoleSpeaker}); !errors.As(err, &e) || e.Code != ErrorModeratorRequired {
+		t.Fatalf("speaker mute another => %v", err)
+	}
+}
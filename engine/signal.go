@@ -0,0 +1,68 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	signalDebouncePeriod = 100 * time.Millisecond
+)
+
+type signaler interface {
+	offer(peer *Peer, offer *webrtc.SessionDescription)
+	candidate(peer *Peer, candi webrtc.ICECandidateInit)
+}
+
+// renegotiate coalesces the publisher changes of a room, then pushes a fresh
+// subscribe offer to every peer connected through a signaling channel
+func (room *pmap) renegotiate() {
+	if !room.negotiating.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		time.Sleep(signalDebouncePeriod)
+		room.negotiating.Store(false)
+		for _, peer := range room.PeersCopy() {
+			if peer.signaler != nil && peer.cid != peerTrackClosedId {
+				peer.signal(room)
+			}
+		}
+	}()
+}
+
+func (peer *Peer) signal(room *pmap) {
+	room.Lock()
+	defer room.Unlock()
+
+	peer.RLock()
+	mixed, state := peer.mixed, peer.pc.SignalingState()
+	peer.RUnlock()
+	if peer.cid == peerTrackClosedId || state != webrtc.SignalingStateStable {
+		return
+	}
+
+	var renegotiated bool
+	err := lockRunWithTimeout(func() error {
+		res, err := peer.doSubscribe(room, mixed)
+		if err != nil {
+			_ = peer.close(leaveReasonError)
+			return err
+		}
+		renegotiated = res
+		return nil
+	}, peerTrackConnectionTimeout)
+	logger.Printf("peer.signal(%s) => %t %v", peer.id(), renegotiated, err)
+	if err == nil && renegotiated {
+		peer.signaler.offer(peer, peer.pc.LocalDescription())
+	}
+}
+
+func (peer *Peer) trickleCandidate(c *webrtc.ICECandidate) {
+	if c == nil {
+		return
+	}
+	peer.signaler.candidate(peer, c.ToJSON())
+}
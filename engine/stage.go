@@ -0,0 +1,201 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/pion/webrtc/v4"
+)
+
+type stage struct {
+	sync.Mutex
+	hands map[string]time.Time
+}
+
+func stageAllocate() *stage {
+	return &stage{hands: make(map[string]time.Time)}
+}
+
+func (s *stage) raise(uid string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.hands[uid]; ok {
+		return false
+	}
+	s.hands[uid] = time.Now()
+	return true
+}
+
+func (s *stage) lower(uid string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	_, ok := s.hands[uid]
+	delete(s.hands, uid)
+	return ok
+}
+
+// queue lists the raised hands in order, and forgets the users who have
+// left the room or are no longer listeners
+func (room *pmap) queue() []map[string]any {
+	peers := room.PeersCopy()
+	s := room.stage
+	s.Lock()
+	defer s.Unlock()
+
+	list := make([]map[string]any, 0, len(s.hands))
+	for uid, at := range s.hands {
+		p := peers[uid]
+		if p == nil || p.cid == peerTrackClosedId || p.role != peerRoleListener {
+			delete(s.hands, uid)
+			continue
+		}
+		list = append(list, map[string]any{
+			"id":        uid,
+			"track":     p.cid,
+			"raised_at": at,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i]["raised_at"].(time.Time).Before(list[j]["raised_at"].(time.Time))
+	})
+	return list
+}
+
+func (r *Router) hands(rid string) []map[string]any {
+	room := r.engine.getRoom(rid)
+	if room == nil {
+		return []map[string]any{}
+	}
+	return room.queue()
+}
+
+func (r *Router) hand(rid, uid, cid string, raise bool) ([]map[string]any, error) {
+	room, peer, err := r.engine.GetPeer(rid, uid, cid)
+	if err != nil {
+		return nil, err
+	}
+	if !raise {
+		if room.stage.lower(uid) {
+			room.webhook.peer(peer, webhookEventLowerHand, "")
+		}
+		return room.queue(), nil
+	}
+	if peer.role != peerRoleListener {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("peer %s is already a speaker", uid))
+	}
+	if room.stage.raise(uid) {
+		room.webhook.peer(peer, webhookEventRaiseHand, "")
+	}
+	return room.queue(), nil
+}
+
+// promote moves a listener on to the stage, a listener that joined without
+// a microphone gets an audio transceiver and a new offer to answer
+func (r *Router) promote(rid, uid string, by *actor) (map[string]any, error) {
+	if err := by.moderate("promote", uid); err != nil {
+		return nil, err
+	}
+	room := r.engine.getRoom(rid)
+	if room == nil {
+		return nil, buildError(ErrorPeerNotFound, fmt.Errorf("peer %s not found in %s", uid, rid))
+	}
+	room.Lock()
+	defer room.Unlock()
+
+	peer := room.m[uid]
+	if peer == nil || peer.cid == peerTrackClosedId {
+		return nil, buildError(ErrorPeerNotFound, fmt.Errorf("peer %s not found in %s", uid, rid))
+	}
+	renegotiated, err := peer.promote()
+	logger.Printf("peer.promote(%s) => %t %v", peer.id(), renegotiated, err)
+	if err != nil {
+		return nil, err
+	}
+	room.stage.lower(uid)
+	room.webhook.peer(peer, webhookEventPromote, "")
+	room.renegotiate()
+	if renegotiated && peer.signaler != nil {
+		peer.signaler.offer(peer, peer.pc.LocalDescription())
+	}
+	return map[string]any{
+		"id":    peer.uid,
+		"track": peer.cid,
+		"role":  peer.role,
+	}, nil
+}
+
+func (peer *Peer) promote() (bool, error) {
+	peer.Lock()
+	defer peer.Unlock()
+
+	var renegotiated bool
+	err := lockRunWithTimeout(func() error {
+		if peer.role != peerRoleListener {
+			return nil
+		}
+		peer.role = peerRoleSpeaker
+		peer.listenOnly.Store(false)
+		for _, t := range peer.tracks {
+			if t.kind == webrtc.RTPCodecTypeAudio {
+				return nil
+			}
+		}
+		_, err := peer.pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		})
+		if err != nil {
+			return buildError(ErrorServerAddTransceiver, err)
+		}
+		offer, err := peer.pc.CreateOffer(nil)
+		if err != nil {
+			return buildError(ErrorServerCreateOffer, err)
+		}
+		err = setLocalDescription(peer.pc, offer)
+		if err != nil {
+			return buildError(ErrorServerSetLocalOffer, err)
+		}
+		renegotiated = true
+		return nil
+	}, peerTrackReadTimeout)
+	return renegotiated, err
+}
+
+// demote moves a speaker back to the audience, its tracks stay received
+// but are no longer forwarded, so the subscribers drop them
+func (r *Router) demote(rid, uid string, by *actor) (map[string]any, error) {
+	if by.uid != uid {
+		if err := by.moderate("demote", uid); err != nil {
+			return nil, err
+		}
+	}
+	room := r.engine.getRoom(rid)
+	if room == nil {
+		return nil, buildError(ErrorPeerNotFound, fmt.Errorf("peer %s not found in %s", uid, rid))
+	}
+	room.Lock()
+	defer room.Unlock()
+
+	peer := room.m[uid]
+	if peer == nil || peer.cid == peerTrackClosedId {
+		return nil, buildError(ErrorPeerNotFound, fmt.Errorf("peer %s not found in %s", uid, rid))
+	}
+	peer.Lock()
+	changed := peer.role != peerRoleListener
+	peer.role = peerRoleListener
+	peer.listenOnly.Store(true)
+	peer.Unlock()
+	if changed {
+		room.webhook.peer(peer, webhookEventDemote, "")
+		room.renegotiate()
+	}
+	return map[string]any{
+		"id":    peer.uid,
+		"track": peer.cid,
+		"role":  peer.role,
+	}, nil
+}
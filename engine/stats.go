@@ -0,0 +1,126 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func (r *Router) stats(rid, uid string) (map[string]any, error) {
+	var peer *Peer
+	if room := r.engine.getRoom(rid); room != nil {
+		peer = room.PeersCopy()[uid]
+	}
+	if peer == nil || peer.cid == peerTrackClosedId {
+		return nil, buildError(ErrorPeerNotFound, fmt.Errorf("peer %s not found in %s", uid, rid))
+	}
+	return peer.stats(), nil
+}
+
+// stats reads the report of the connection, the inbound streams of the
+// tracks published by the peer, and the outbound streams of its senders
+// with the receiver reports of the peer
+func (p *Peer) stats() map[string]any {
+	p.RLock()
+	tracks := make([]*Track, 0, len(p.tracks))
+	for _, t := range p.tracks {
+		tracks = append(tracks, t)
+	}
+	senders := make([]*Sender, 0, len(p.publishers))
+	for _, s := range p.publishers {
+		senders = append(senders, s)
+	}
+	p.RUnlock()
+
+	report := p.pc.GetStats()
+	inbounds := make(map[webrtc.SSRC]webrtc.InboundRTPStreamStats)
+	outbounds := make(map[webrtc.SSRC]webrtc.OutboundRTPStreamStats)
+	remotes := make(map[webrtc.SSRC]webrtc.RemoteInboundRTPStreamStats)
+	for _, s := range report {
+		switch s := s.(type) {
+		case webrtc.InboundRTPStreamStats:
+			inbounds[s.SSRC] = s
+		case webrtc.OutboundRTPStreamStats:
+			outbounds[s.SSRC] = s
+		case webrtc.RemoteInboundRTPStreamStats:
+			remotes[s.SSRC] = s
+		}
+	}
+
+	inbound, outbound := []map[string]any{}, []map[string]any{}
+	for _, t := range tracks {
+		s, ok := inbounds[t.ssrc]
+		if !ok {
+			continue
+		}
+		inbound = append(inbound, map[string]any{
+			"track":            t.id,
+			"kind":             t.kind.String(),
+			"packets_received": s.PacketsReceived,
+			"packets_lost":     s.PacketsLost,
+			"jitter":           s.Jitter,
+			"bytes_received":   s.BytesReceived,
+		})
+	}
+	for _, sender := range senders {
+		for _, e := range sender.rtp.GetParameters().Encodings {
+			s, ok := outbounds[e.SSRC]
+			if !ok {
+				continue
+			}
+			remote := remotes[e.SSRC]
+			outbound = append(outbound, map[string]any{
+				"id":            sender.uid,
+				"track":         sender.id,
+				"packets_sent":  s.PacketsSent,
+				"bytes_sent":    s.BytesSent,
+				"packets_lost":  remote.PacketsLost,
+				"fraction_lost": remote.FractionLost,
+				"jitter":        remote.Jitter,
+				"rtt":           remote.RoundTripTime,
+			})
+		}
+	}
+
+	return map[string]any{
+		"id":         p.uid,
+		"track":      p.cid,
+		"role":       p.role,
+		"connection": p.pc.ConnectionState().String(),
+		"ice":        p.pc.ICEConnectionState().String(),
+		"signaling":  p.pc.SignalingState().String(),
+		"transport":  selectedTransport(report),
+		"inbound":    inbound,
+		"outbound":   outbound,
+	}
+}
+
+// selectedTransport finds the nominated candidate pair, the transport stats
+// of an ICE lite agent do not always carry the selected pair id
+func selectedTransport(report webrtc.StatsReport) map[string]any {
+	var pair *webrtc.ICECandidatePairStats
+	for _, s := range report {
+		cp, ok := s.(webrtc.ICECandidatePairStats)
+		if !ok || !cp.Nominated || cp.State != webrtc.StatsICECandidatePairStateSucceeded {
+			continue
+		}
+		if pair == nil || cp.LastPacketReceivedTimestamp > pair.LastPacketReceivedTimestamp {
+			pair = &cp
+		}
+	}
+	if pair == nil {
+		return nil
+	}
+	local, _ := report[pair.LocalCandidateID].(webrtc.ICECandidateStats)
+	remote, _ := report[pair.RemoteCandidateID].(webrtc.ICECandidateStats)
+	relayed := local.CandidateType == webrtc.ICECandidateTypeRelay || remote.CandidateType == webrtc.ICECandidateTypeRelay
+	return map[string]any{
+		"protocol": local.Protocol,
+		"relay":    relayed,
+		"local":    fmt.Sprintf("%s %s:%d", local.CandidateType, local.IP, local.Port),
+		"remote":   fmt.Sprintf("%s %s:%d", remote.CandidateType, remote.IP, remote.Port),
+		"rtt":      pair.CurrentRoundTripTime,
+		"sent":     pair.BytesSent,
+		"received": pair.BytesReceived,
+	}
+}
@@ -5,7 +5,15 @@ import (
 	"crypto/sha1"
 	"encoding/base64"
 	"fmt"
+	"net"
 	"time"
+
+	"github.com/MixinNetwork/mixin/logger"
+	turnserver "github.com/pion/turn/v5"
+)
+
+const (
+	turnRealm = "kraken"
 )
 
 type NTS struct {
@@ -35,3 +43,85 @@ func turn(conf *Configuration, uid string) ([]*NTS, error) {
 	}
 	return []*NTS{ownUDP, ownTCP}, nil
 }
+
+// ServeTURN runs the embedded TURN server on both UDP and TCP, it accepts
+// the same time limited credentials handed out by the turn RPC
+func ServeTURN(engine *Engine, conf *Configuration) (*turnserver.Server, error) {
+	port := conf.Turn.Port
+	if conf.Turn.Secret == "" {
+		return nil, fmt.Errorf("embedded turn server on port %d without secret", port)
+	}
+	if conf.Turn.Host == "" {
+		conf.Turn.Host = fmt.Sprintf("turn:%s:%d", engine.IP, port)
+	}
+
+	udp, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	tcp, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		_ = udp.Close()
+		return nil, err
+	}
+	server, err := turnserver.NewServer(turnserver.ServerConfig{
+		Realm:       turnRealm,
+		AuthHandler: turnserver.LongTermTURNRESTAuthHandler(conf.Turn.Secret, nil),
+		PacketConnConfigs: []turnserver.PacketConnConfig{{
+			PacketConn:            udp,
+			RelayAddressGenerator: engine.turnRelayAddressGenerator(),
+			PermissionHandler:     engine.turnPermissionHandler(),
+		}},
+		ListenerConfigs: []turnserver.ListenerConfig{{
+			Listener:              tcp,
+			RelayAddressGenerator: engine.turnRelayAddressGenerator(),
+			PermissionHandler:     engine.turnPermissionHandler(),
+		}},
+	})
+	if err != nil {
+		_ = udp.Close()
+		_ = tcp.Close()
+		return nil, err
+	}
+	engine.turn = server
+	logger.Printf("ServeTURN(%s, :%d)\n", conf.Turn.Host, port)
+	return server, nil
+}
+
+// turnRelayAddressGenerator allocates the relays in the port range of the
+// engine, so the firewall rules of the peer connections also cover them
+func (engine *Engine) turnRelayAddressGenerator() turnserver.RelayAddressGenerator {
+	ip := net.ParseIP(engine.IP)
+	if engine.PortMin > 0 && engine.PortMax >= engine.PortMin {
+		return &turnserver.RelayAddressGeneratorPortRange{
+			RelayAddress: ip,
+			Address:      "0.0.0.0",
+			MinPort:      engine.PortMin,
+			MaxPort:      engine.PortMax,
+		}
+	}
+	return &turnserver.RelayAddressGeneratorStatic{
+		RelayAddress: ip,
+		Address:      "0.0.0.0",
+	}
+}
+
+// turnPermissionHandler only lets the relays reach the engine itself, which
+// is the sole legitimate peer of an SFU, so the embedded server never turns
+// into an open relay into the loopback, private or metadata networks
+func (engine *Engine) turnPermissionHandler() turnserver.PermissionHandler {
+	ip := net.ParseIP(engine.IP)
+	return func(src net.Addr, peer net.IP) bool {
+		if peer.IsLoopback() || peer.IsUnspecified() || peer.IsMulticast() {
+			return false
+		}
+		if peer.IsLinkLocalUnicast() || peer.IsLinkLocalMulticast() {
+			return false
+		}
+		if !peer.Equal(ip) {
+			logger.Verbosef("turn permission denied %s => %s\n", src, peer)
+			return false
+		}
+		return true
+	}
+}
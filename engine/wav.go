@@ -0,0 +1,68 @@
+package engine
+
+import (
+	"encoding/binary"
+	"os"
+)
+
+const wavHeaderSize = 44
+
+type wavWriter struct {
+	file    *os.File
+	rate    uint32
+	samples uint32
+}
+
+func createWav(path string, rate uint32) (*wavWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &wavWriter{file: f, rate: rate}
+	_, err = f.Write(w.header())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *wavWriter) header() []byte {
+	size := w.samples * 2
+	h := make([]byte, wavHeaderSize)
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], 36+size)
+	copy(h[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], 1)
+	binary.LittleEndian.PutUint16(h[22:], 1)
+	binary.LittleEndian.PutUint32(h[24:], w.rate)
+	binary.LittleEndian.PutUint32(h[28:], w.rate*2)
+	binary.LittleEndian.PutUint16(h[32:], 2)
+	binary.LittleEndian.PutUint16(h[34:], 16)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], size)
+	return h
+}
+
+func (w *wavWriter) write(pcm []int16) error {
+	buf := make([]byte, len(pcm)*2)
+	for i, s := range pcm {
+		binary.LittleEndian.PutUint16(buf[i*2:], uint16(s))
+	}
+	_, err := w.file.Write(buf)
+	if err != nil {
+		return err
+	}
+	w.samples += uint32(len(pcm))
+	return nil
+}
+
+func (w *wavWriter) close() error {
+	_, err := w.file.WriteAt(w.header(), 0)
+	if err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
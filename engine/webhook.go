@@ -0,0 +1,174 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/gofrs/uuid/v5"
+)
+
+const (
+	webhookEventJoin       = "join"
+	webhookEventOnTrack    = "ontrack"
+	webhookEventMute       = "mute"
+	webhookEventUnmute     = "unmute"
+	webhookEventICERestart = "ice-restart"
+	webhookEventLeave      = "leave"
+	webhookEventRoomEmpty  = "room-empty"
+	webhookEventRaiseHand  = "raise-hand"
+	webhookEventLowerHand  = "lower-hand"
+	webhookEventPromote    = "promote"
+	webhookEventDemote     = "demote"
+
+	leaveReasonEnd      = "end"
+	leaveReasonReplaced = "replaced"
+	leaveReasonTimeout  = "timeout"
+	leaveReasonTrack    = "track-ended"
+	leaveReasonError    = "error"
+	leaveReasonFailed   = "failed"
+	leaveReasonKicked   = "kicked"
+	leaveReasonBanned   = "banned"
+	leaveReasonShutdown = "shutdown"
+	leaveReasonSignal   = "disconnected"
+
+	webhookSignatureHeader = "Kraken-Signature"
+	webhookDefaultQueue    = 1024
+	webhookDefaultRetries  = 5
+	webhookWorkers         = 4
+	webhookBackoffBase     = time.Second
+	webhookBackoffMaximum  = time.Minute
+)
+
+type webhookEvent struct {
+	Id        string    `json:"id"`
+	Action    string    `json:"action"`
+	Rid       string    `json:"rid"`
+	Uid       string    `json:"uid,omitempty"`
+	Cid       string    `json:"cid,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+
+	url      string
+	attempts int
+}
+
+type webhook struct {
+	url     string
+	secret  []byte
+	retries int
+	client  *http.Client
+	queue   chan *webhookEvent
+}
+
+func buildWebhook(conf *Configuration) *webhook {
+	size, retries := conf.Webhook.Queue, conf.Webhook.Retries
+	if size <= 0 {
+		size = webhookDefaultQueue
+	}
+	if retries <= 0 {
+		retries = webhookDefaultRetries
+	}
+	hook := &webhook{
+		url:     conf.Webhook.URL,
+		secret:  []byte(conf.Webhook.Secret),
+		retries: retries,
+		client:  &http.Client{Timeout: 5 * time.Second},
+		queue:   make(chan *webhookEvent, size),
+	}
+	for range webhookWorkers {
+		go hook.loop()
+	}
+	return hook
+}
+
+// peer events of relayed peers are left to the webhook of their origin
+func (hook *webhook) peer(peer *Peer, action, reason string) {
+	if peer.relay != "" {
+		return
+	}
+	evt := webhookEvent{Action: action, Rid: peer.rid, Uid: peer.uid, Cid: peer.cid, Reason: reason}
+	hook.emit(evt, peer.callback)
+}
+
+func (hook *webhook) room(room *pmap, action string) {
+	hook.emit(webhookEvent{Action: action, Rid: room.id}, "")
+}
+
+func (hook *webhook) emit(evt webhookEvent, callback string) {
+	evt.Id = uuid.Must(uuid.NewV4()).String()
+	evt.Timestamp = time.Now().UTC()
+	for _, url := range []string{hook.url, callback} {
+		if url == "" {
+			continue
+		}
+		e := evt
+		e.url = url
+		hook.enqueue(&e)
+	}
+}
+
+func (hook *webhook) enqueue(evt *webhookEvent) {
+	select {
+	case hook.queue <- evt:
+	default:
+		logger.Printf("webhook.enqueue(%s, %s, %s) queue full\n", evt.Action, evt.Rid, evt.Uid)
+		metricWebhookFailures.WithLabelValues("overflow").Inc()
+	}
+}
+
+func (hook *webhook) loop() {
+	for evt := range hook.queue {
+		err := hook.post(evt)
+		if err == nil {
+			continue
+		}
+		evt.attempts += 1
+		logger.Verbosef("webhook.post(%s, %s, %d) => %v\n", evt.Action, evt.url, evt.attempts, err)
+		if evt.attempts > hook.retries {
+			logger.Printf("webhook.post(%s, %s) dropped after %d attempts\n", evt.Action, evt.url, evt.attempts)
+			metricWebhookFailures.WithLabelValues("dropped").Inc()
+			continue
+		}
+		metricWebhookFailures.WithLabelValues("retried").Inc()
+		backoff := min(webhookBackoffBase<<(evt.attempts-1), webhookBackoffMaximum)
+		time.AfterFunc(backoff, func() { hook.enqueue(evt) })
+	}
+}
+
+func (hook *webhook) post(evt *webhookEvent) error {
+	body, _ := json.Marshal(evt)
+	req, err := http.NewRequest("POST", evt.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(hook.secret) > 0 {
+		mac := hmac.New(sha256.New, hook.secret)
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := hook.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (room *pmap) checkEmpty() {
+	if !room.empty() || !room.vacant.CompareAndSwap(false, true) {
+		return
+	}
+	room.webhook.room(room, webhookEventRoomEmpty)
+}
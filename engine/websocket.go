@@ -0,0 +1,259 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/gofrs/uuid/v5"
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	websocketReadLimit    = 64 * 1024
+	websocketPongTimeout  = 60 * time.Second
+	websocketPingPeriod   = 25 * time.Second
+	websocketWriteTimeout = 10 * time.Second
+	websocketQueueSize    = 64
+)
+
+type session struct {
+	sync.Mutex
+	id     string
+	token  string
+	conn   *websocket.Conn
+	queue  chan any
+	ready  map[string]bool
+	held   map[string][]any
+	peers  map[string]*sessionPeer
+	closed bool
+}
+
+type sessionPeer struct {
+	rid string
+	uid string
+}
+
+func (impl *R) socket(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	token := bearerToken(r)
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
+		CheckOrigin:     impl.checkOrigin,
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Printf("RPC.websocket() => %v\n", err)
+		return
+	}
+	s := &session{
+		id:    uuid.Must(uuid.NewV4()).String(),
+		token: token,
+		conn:  conn,
+		queue: make(chan any, websocketQueueSize),
+		ready: make(map[string]bool),
+		held:  make(map[string][]any),
+		peers: make(map[string]*sessionPeer),
+	}
+	logger.Printf("RPC.websocket(%s) connected from %s\n", s.id, r.RemoteAddr)
+	go s.loopWrite()
+	err = impl.loopRead(s)
+	logger.Printf("RPC.websocket(%s) closed with %v\n", s.id, err)
+	s.close()
+	impl.router.disconnect(s)
+}
+
+// checkOrigin only lets the pages of the same origin or the configured
+// origins open a WebSocket, so that no other page is able to drive the RPC
+// from the browser of a user, the clients without origin are not browsers
+func (impl *R) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, o := range impl.conf.RPC.Origins {
+		if strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (impl *R) loopRead(s *session) error {
+	s.conn.SetReadLimit(websocketReadLimit)
+	_ = s.conn.SetReadDeadline(time.Now().Add(websocketPongTimeout))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(websocketPongTimeout))
+	})
+
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		_ = s.conn.SetReadDeadline(time.Now().Add(websocketPongTimeout))
+
+		var call Call
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.UseNumber()
+		if err := d.Decode(&call); err != nil {
+			return err
+		}
+		startAt := time.Now()
+		logger.Printf("RPC.websocket(%s, id: %s, method: %s, params: %v)\n", s.id, call.Id, call.Method, call.Params)
+		var res any
+		claims, err := impl.authorize(s.token, call.Method, call.Params)
+		if err == nil {
+			res, err = impl.dispatch(&call, claims, s)
+		}
+		if err != nil {
+			s.send(map[string]any{"id": call.Id, "error": err})
+			logger.Printf("RPC.websocket(%s, id: %s, method: %s, time: %f) ERROR %s\n",
+				s.id, call.Id, call.Method, time.Since(startAt).Seconds(), err.Error())
+			observeRPC(call.Method, startAt, err)
+			continue
+		}
+		s.send(map[string]any{"id": call.Id, "data": res})
+		logger.Printf("RPC.websocket(%s, id: %s, method: %s, time: %f) OK\n",
+			s.id, call.Id, call.Method, time.Since(startAt).Seconds())
+		observeRPC(call.Method, startAt, nil)
+		if call.Method == "publish" || call.Method == "listen" {
+			rid, uid := call.Params[0].(string), call.Params[1].(string)
+			s.release(rid, uid, res.(map[string]any)["track"].(string))
+		}
+	}
+}
+
+func (s *session) loopWrite() {
+	ticker := time.NewTicker(websocketPingPeriod)
+	defer ticker.Stop()
+	defer s.conn.Close()
+
+	for {
+		select {
+		case msg, ok := <-s.queue:
+			if !ok {
+				_ = s.conn.WriteControl(websocket.CloseMessage, nil, time.Now().Add(websocketWriteTimeout))
+				return
+			}
+			_ = s.conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+			err := s.conn.WriteJSON(msg)
+			if err != nil {
+				logger.Verbosef("RPC.websocket(%s) write => %v\n", s.id, err)
+				return
+			}
+		case <-ticker.C:
+			err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(websocketWriteTimeout))
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *session) send(msg any) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.enqueue(msg)
+}
+
+func (s *session) enqueue(msg any) {
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- msg:
+	default:
+		logger.Printf("RPC.websocket(%s) queue full\n", s.id)
+		s.closed = true
+		close(s.queue)
+	}
+}
+
+func (s *session) close() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.queue)
+}
+
+// release flushes the candidates gathered before the publish response,
+// so the client always knows the track id when they arrive
+func (s *session) release(rid, uid, cid string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.peers[cid] = &sessionPeer{rid: rid, uid: uid}
+	s.ready[cid] = true
+	for _, msg := range s.held[cid] {
+		s.enqueue(msg)
+	}
+	delete(s.held, cid)
+}
+
+// disconnect closes the peers published through the session, they are no
+// longer able to receive the pushed offers, unless already replaced by a
+// publish through another channel
+func (r *Router) disconnect(s *session) {
+	s.Lock()
+	peers := s.peers
+	s.peers = make(map[string]*sessionPeer)
+	s.Unlock()
+
+	for cid, sp := range peers {
+		_, peer, err := r.engine.GetPeer(sp.rid, sp.uid, cid)
+		if err != nil || peer.signaler != signaler(s) {
+			continue
+		}
+		err = peer.CloseWithTimeout(leaveReasonSignal)
+		logger.Printf("RPC.websocket(%s) disconnect(%s) => %v\n", s.id, peer.id(), err)
+	}
+}
+
+func (s *session) offer(peer *Peer, offer *webrtc.SessionDescription) {
+	jsep, _ := json.Marshal(offer)
+	s.send(&Call{
+		Id:     uuid.Must(uuid.NewV4()).String(),
+		Method: "offer",
+		Params: []any{peer.rid, peer.uid, peer.cid, string(jsep)},
+	})
+}
+
+func (s *session) candidate(peer *Peer, candi webrtc.ICECandidateInit) {
+	b, _ := json.Marshal(candi)
+	msg := &Call{
+		Id:     uuid.Must(uuid.NewV4()).String(),
+		Method: "candidate",
+		Params: []any{peer.rid, peer.uid, peer.cid, string(b)},
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.ready[peer.cid] {
+		s.held[peer.cid] = append(s.held[peer.cid], msg)
+		return
+	}
+	s.enqueue(msg)
+}
@@ -0,0 +1,32 @@
+package engine
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	conf := &Configuration{}
+	conf.RPC.Origins = []string{"https://kraken.fm/"}
+	impl := &R{conf: conf}
+
+	cases := []struct {
+		origin string
+		ok     bool
+	}{
+		{"", true},
+		{"http://engine.kraken.fm:7000", true},
+		{"https://kraken.fm", true},
+		{"https://evil.example", false},
+		{"http://kraken.fm", false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "http://engine.kraken.fm:7000/ws", nil)
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		if ok := impl.checkOrigin(r); ok != c.ok {
+			t.Fatalf("checkOrigin(%s) => %t", c.origin, ok)
+		}
+	}
+}
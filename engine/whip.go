@@ -0,0 +1,374 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/gofrs/uuid/v5"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	whipBodyLimit          = 64 * 1024
+	whipContentTypeSDP     = "application/sdp"
+	whipContentTypeSDPFrag = "application/trickle-ice-sdpfrag"
+)
+
+type Viewer struct {
+	id  string
+	rid string
+	uid string
+	cid string
+	pc  *webrtc.PeerConnection
+}
+
+type vmap struct {
+	sync.RWMutex
+	m map[string]*Viewer
+}
+
+func vmapAllocate() *vmap {
+	vm := new(vmap)
+	vm.m = make(map[string]*Viewer)
+	return vm
+}
+
+func (vm *vmap) get(rid, uid, id string) *Viewer {
+	vm.RLock()
+	defer vm.RUnlock()
+
+	v := vm.m[id]
+	if v == nil || v.rid != rid || v.uid != uid {
+		return nil
+	}
+	return v
+}
+
+func (vm *vmap) remove(id string) *Viewer {
+	vm.Lock()
+	defer vm.Unlock()
+
+	v := vm.m[id]
+	delete(vm.m, id)
+	return v
+}
+
+// close stops every viewer like a WHEP DELETE, including the sessions
+// pulled by the relays of other engines
+func (vm *vmap) close() int {
+	vm.Lock()
+	viewers := vm.m
+	vm.m = make(map[string]*Viewer)
+	vm.Unlock()
+
+	return closeViewers(viewers)
+}
+
+// closePeer stops the viewers of a publisher once it leaves or publishes
+// again, they never follow the tracks of another connection
+func (vm *vmap) closePeer(rid, uid, cid string) int {
+	vm.Lock()
+	viewers := make(map[string]*Viewer)
+	for id, v := range vm.m {
+		if v.rid == rid && v.uid == uid && v.cid == cid {
+			viewers[id] = v
+			delete(vm.m, id)
+		}
+	}
+	vm.Unlock()
+
+	return closeViewers(viewers)
+}
+
+func closeViewers(viewers map[string]*Viewer) int {
+	for _, v := range viewers {
+		err := lockRunWithTimeout(func() error {
+			return v.pc.Close()
+		}, peerTrackReadTimeout)
+		logger.Printf("viewer.close(%s:%s:%s) => %v\n", v.rid, v.uid, v.id, err)
+	}
+	return len(viewers)
+}
+
+func (r *Router) play(rid, uid string, jsep string) (*Viewer, *webrtc.SessionDescription, error) {
+	if r.engine.draining.Load() {
+		return nil, nil, buildError(ErrorServerDraining, fmt.Errorf("engine draining"))
+	}
+	var offer webrtc.SessionDescription
+	err := json.Unmarshal([]byte(jsep), &offer)
+	if err != nil {
+		return nil, nil, buildError(ErrorInvalidSDP, err)
+	}
+	if offer.Type != webrtc.SDPTypeOffer {
+		return nil, nil, buildError(ErrorInvalidSDP, fmt.Errorf("invalid sdp type %s", offer.Type))
+	}
+
+	var pub *Peer
+	if room := r.engine.getRoom(rid); room != nil {
+		pub = room.PeersCopy()[uid]
+	}
+	if pub != nil && pub.cid == peerTrackClosedId {
+		pub = nil
+	}
+	if pub == nil {
+		return nil, nil, buildError(ErrorPeerNotFound, fmt.Errorf("peer %s not found in %s", uid, rid))
+	}
+
+	viewer := &Viewer{id: uuid.Must(uuid.NewV4()).String(), rid: rid, uid: uid, cid: pub.cid}
+	err = lockRunWithTimeout(func() error {
+		pc, err := r.newPeerConnection()
+		if err != nil {
+			return err
+		}
+		viewer.pc = pc
+		err = pc.SetRemoteDescription(offer)
+		if err != nil {
+			return buildError(ErrorServerSetRemoteOffer, err)
+		}
+		for _, t := range pub.tracksCopy() {
+			sender, err := pc.AddTrack(t.local)
+			logger.Printf("pc.AddTrack(%s, %s, %s) => %v %v", viewer.id, pub.id(), t.id, sender, err)
+			if err != nil {
+				return buildError(ErrorServerAddTransceiver, err)
+			}
+			go pub.readSenderRTCP(t, sender)
+		}
+		answer, err := pc.CreateAnswer(nil)
+		if err != nil {
+			return buildError(ErrorServerCreateAnswer, err)
+		}
+		err = setLocalDescription(pc, answer)
+		if err != nil {
+			return buildError(ErrorServerSetLocalAnswer, err)
+		}
+		return nil
+	}, peerTrackConnectionTimeout)
+	if err != nil {
+		if viewer.pc != nil {
+			_ = viewer.pc.Close()
+		}
+		return nil, nil, err
+	}
+
+	viewer.pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		logger.Printf("HandleViewer(%s:%s:%s) OnConnectionStateChange(%s)\n", rid, uid, viewer.id, state)
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			_ = r.stop(rid, uid, viewer.id)
+		}
+	})
+	r.viewers.Lock()
+	r.viewers.m[viewer.id] = viewer
+	r.viewers.Unlock()
+	if pub.cid != viewer.cid {
+		r.viewers.closePeer(rid, uid, viewer.cid)
+		return nil, nil, buildError(ErrorPeerClosed, fmt.Errorf("peer %s closed in %s", uid, rid))
+	}
+	return viewer, viewer.pc.LocalDescription(), nil
+}
+
+func (r *Router) stop(rid, uid, id string) error {
+	viewer := r.viewers.get(rid, uid, id)
+	if viewer == nil {
+		return buildError(ErrorPeerNotFound, fmt.Errorf("viewer %s not found in %s", id, rid))
+	}
+	r.viewers.remove(id)
+	return lockRunWithTimeout(func() error {
+		return viewer.pc.Close()
+	}, peerTrackReadTimeout)
+}
+
+func (r *Router) watch(rid, uid, id string, candi string) error {
+	var ici webrtc.ICECandidateInit
+	err := json.Unmarshal([]byte(candi), &ici)
+	if err != nil {
+		return buildError(ErrorInvalidCandidate, err)
+	}
+	viewer := r.viewers.get(rid, uid, id)
+	if viewer == nil {
+		return buildError(ErrorPeerNotFound, fmt.Errorf("viewer %s not found in %s", id, rid))
+	}
+	return lockRunWithTimeout(func() error {
+		return viewer.pc.AddICECandidate(ici)
+	}, peerTrackReadTimeout)
+}
+
+func (impl *R) whip(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	claims, err := impl.authorize(bearerToken(r), "publish", []any{params["rid"], params["uid"]})
+	if err != nil {
+		renderWHIPError(w, err)
+		return
+	}
+	role, err := publishRole(claims, "")
+	if err != nil {
+		renderWHIPError(w, err)
+		return
+	}
+	offer, ok := readWHIPBody(w, r, whipContentTypeSDP)
+	if !ok {
+		return
+	}
+	jsep, _ := json.Marshal(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer})
+	cid, answer, err := impl.router.publish(params["rid"], params["uid"], string(jsep), 0, "", false, role, nil)
+	if err != nil {
+		renderWHIPError(w, err)
+		return
+	}
+	location := fmt.Sprintf("/whip/%s/%s/%s", params["rid"], params["uid"], cid)
+	renderWHIPAnswer(w, location, answer)
+}
+
+func (impl *R) whipPatch(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	_, err := impl.authorize(bearerToken(r), "trickle", []any{params["rid"], params["uid"], params["cid"]})
+	if err != nil {
+		renderWHIPError(w, err)
+		return
+	}
+	frag, ok := readWHIPBody(w, r, whipContentTypeSDPFrag)
+	if !ok {
+		return
+	}
+	for _, candi := range parseSDPFragment(frag) {
+		err := impl.router.trickle(params["rid"], params["uid"], params["cid"], candi)
+		if err != nil {
+			renderWHIPError(w, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (impl *R) whipDelete(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	_, err := impl.authorize(bearerToken(r), "end", []any{params["rid"], params["uid"], params["cid"]})
+	if err != nil {
+		renderWHIPError(w, err)
+		return
+	}
+	err = impl.router.end(params["rid"], params["uid"], params["cid"])
+	if err != nil {
+		renderWHIPError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (impl *R) whep(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	_, err := impl.authorize(bearerToken(r), "whep", []any{params["rid"], params["uid"]})
+	if err != nil {
+		renderWHIPError(w, err)
+		return
+	}
+	offer, ok := readWHIPBody(w, r, whipContentTypeSDP)
+	if !ok {
+		return
+	}
+	jsep, _ := json.Marshal(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer})
+	viewer, answer, err := impl.router.play(params["rid"], params["uid"], string(jsep))
+	if err != nil {
+		renderWHIPError(w, err)
+		return
+	}
+	location := fmt.Sprintf("/whep/%s/%s/%s", params["rid"], params["uid"], viewer.id)
+	renderWHIPAnswer(w, location, answer)
+}
+
+func (impl *R) whepPatch(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	_, err := impl.authorize(bearerToken(r), "whep", []any{params["rid"], params["uid"]})
+	if err != nil {
+		renderWHIPError(w, err)
+		return
+	}
+	frag, ok := readWHIPBody(w, r, whipContentTypeSDPFrag)
+	if !ok {
+		return
+	}
+	for _, candi := range parseSDPFragment(frag) {
+		err := impl.router.watch(params["rid"], params["uid"], params["sid"], candi)
+		if err != nil {
+			renderWHIPError(w, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (impl *R) whepDelete(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	_, err := impl.authorize(bearerToken(r), "whep", []any{params["rid"], params["uid"]})
+	if err != nil {
+		renderWHIPError(w, err)
+		return
+	}
+	err = impl.router.stop(params["rid"], params["uid"], params["sid"])
+	if err != nil {
+		renderWHIPError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func readWHIPBody(w http.ResponseWriter, r *http.Request, contentType string) (string, bool) {
+	if ct := r.Header.Get("Content-Type"); !strings.HasPrefix(ct, contentType) {
+		http.Error(w, fmt.Sprintf("invalid content type %s", ct), http.StatusUnsupportedMediaType)
+		return "", false
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, whipBodyLimit))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return string(body), true
+}
+
+func renderWHIPAnswer(w http.ResponseWriter, location string, answer *webrtc.SessionDescription) {
+	w.Header().Set("Content-Type", whipContentTypeSDP)
+	w.Header().Set("Location", location)
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write([]byte(answer.SDP))
+}
+
+func renderWHIPError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var e Error
+	if errors.As(err, &e) {
+		switch e.Code {
+		case ErrorInvalidParams, ErrorInvalidSDP, ErrorInvalidCandidate:
+			status = http.StatusBadRequest
+		case ErrorPeerNotFound, ErrorPeerClosed, ErrorTrackNotFound:
+			status = http.StatusNotFound
+		case ErrorRoomFull, ErrorServerDraining:
+			status = http.StatusServiceUnavailable
+		case ErrorUnauthorized:
+			status = http.StatusUnauthorized
+		case ErrorForbidden, ErrorModeratorRequired, ErrorListenerUnmute, ErrorPeerBanned:
+			status = http.StatusForbidden
+		}
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// parseSDPFragment converts the candidates of a trickle ICE SDP fragment
+// into the JSON ICE candidate init format used by the trickle RPC
+func parseSDPFragment(frag string) []string {
+	var mid string
+	var candidates []string
+	for _, line := range strings.Split(frag, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = strings.TrimPrefix(line, "a=mid:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			ici := webrtc.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a=")}
+			if mid != "" {
+				ici.SDPMid = &mid
+			}
+			b, _ := json.Marshal(ici)
+			candidates = append(candidates, string(b))
+		}
+	}
+	return candidates
+}
@@ -5,18 +5,21 @@ import (
 	"fmt"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
 	"os/user"
 	"path/filepath"
 	"strings"
 
 	"github.com/MixinNetwork/kraken/engine"
+	"github.com/MixinNetwork/kraken/monitor"
 	"github.com/MixinNetwork/mixin/logger"
 )
 
 const Version = "0.3.3"
 
 func main() {
-	cp := flag.String("c", "~/.kraken/engine.toml", "configuration file path")
+	service := flag.String("s", "engine", "service to run, engine or monitor")
+	cp := flag.String("c", "", "configuration file path, ~/.kraken/<service>.toml by default")
 	flag.Parse()
 
 	args := flag.Args()
@@ -25,6 +28,9 @@ func main() {
 		return
 	}
 
+	if *cp == "" {
+		*cp = fmt.Sprintf("~/.kraken/%s.toml", *service)
+	}
 	if strings.HasPrefix(*cp, "~/") {
 		usr, _ := user.Current()
 		*cp = filepath.Join(usr.HomeDir, (*cp)[2:])
@@ -35,9 +41,21 @@ func main() {
 	go func() {
 		err := http.ListenAndServe(":9000", http.DefaultServeMux)
 		if err != nil {
-			panic(err)
+			logger.Printf("pprof => %v\n", err)
 		}
 	}()
 
-	engine.Boot(*cp, Version)
+	var err error
+	switch *service {
+	case "engine":
+		err = engine.Boot(*cp, Version)
+	case "monitor":
+		err = monitor.Boot(*cp)
+	default:
+		err = fmt.Errorf("invalid service %s", *service)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
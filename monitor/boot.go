@@ -0,0 +1,15 @@
+package monitor
+
+import "github.com/MixinNetwork/mixin/logger"
+
+func Boot(cp string) error {
+	conf, err := Setup(cp)
+	if err != nil {
+		return err
+	}
+	logger.SetLevel(conf.Monitor.LogLevel)
+
+	monitor := NewMonitor(conf)
+	go monitor.Loop()
+	return ServeRPC(monitor, conf)
+}
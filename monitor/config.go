@@ -0,0 +1,31 @@
+package monitor
+
+import (
+	"os"
+
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/pelletier/go-toml"
+)
+
+type Configuration struct {
+	Monitor struct {
+		LogLevel     int    `toml:"log-level"`
+		EngineSecret string `toml:"engine-secret"`
+		ClientSecret string `toml:"client-secret"`
+		Timeout      int    `toml:"timeout"`
+	} `toml:"monitor"`
+	RPC struct {
+		Port int `toml:"port"`
+	} `toml:"rpc"`
+}
+
+func Setup(path string) (*Configuration, error) {
+	logger.Printf("Setup(%s)\n", path)
+	f, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var conf Configuration
+	err = toml.Unmarshal(f, &conf)
+	return &conf, err
+}
@@ -0,0 +1,176 @@
+package monitor
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MixinNetwork/kraken/engine"
+	"github.com/MixinNetwork/mixin/logger"
+)
+
+const (
+	monitorDefaultTimeout = 30 * time.Second
+	monitorAssignGrace    = 5 * time.Minute
+)
+
+type Engine struct {
+	Endpoint    string       `json:"endpoint"`
+	State       engine.State `json:"state"`
+	Rooms       int          `json:"rooms"`
+	HeartbeatAt time.Time    `json:"heartbeat_at"`
+
+	rooms map[string]bool
+}
+
+type assignment struct {
+	endpoint string
+	at       time.Time
+}
+
+// Monitor pins every room to one engine, a room stays on its engine until
+// the engine drains or stops heartbeating
+type Monitor struct {
+	sync.Mutex
+	timeout time.Duration
+	engines map[string]*Engine
+	rooms   map[string]*assignment
+}
+
+func NewMonitor(conf *Configuration) *Monitor {
+	timeout := time.Duration(conf.Monitor.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = monitorDefaultTimeout
+	}
+	return &Monitor{
+		timeout: timeout,
+		engines: make(map[string]*Engine),
+		rooms:   make(map[string]*assignment),
+	}
+}
+
+func (m *Monitor) heartbeat(endpoint string, state engine.State, rooms []string) *Engine {
+	m.Lock()
+	defer m.Unlock()
+
+	e := m.engines[endpoint]
+	if e == nil {
+		logger.Printf("monitor.heartbeat(%s) registered\n", endpoint)
+		e = &Engine{Endpoint: endpoint}
+		m.engines[endpoint] = e
+	}
+	e.State, e.Rooms, e.HeartbeatAt = state, len(rooms), time.Now()
+	e.rooms = make(map[string]bool, len(rooms))
+	for _, rid := range rooms {
+		e.rooms[rid] = true
+		a := m.rooms[rid]
+		if a != nil && a.endpoint != endpoint && (state.Draining || m.engines[a.endpoint].hosts(rid)) {
+			continue
+		}
+		m.rooms[rid] = &assignment{endpoint: endpoint, at: e.HeartbeatAt}
+	}
+	return e.copy()
+}
+
+// copy is returned instead of the engine, which the next heartbeat rewrites
+// while the response is still being encoded
+func (e *Engine) copy() *Engine {
+	c := *e
+	c.rooms = nil
+	return &c
+}
+
+func (e *Engine) hosts(rid string) bool {
+	return e != nil && e.rooms[rid]
+}
+
+// load counts the rooms assigned but not yet reported, so that a burst of
+// new rooms is not routed to the same engine before its next heartbeat
+func (m *Monitor) load(e *Engine) int {
+	load := e.State.ActivePeers + e.State.ActiveListeners
+	for rid, a := range m.rooms {
+		if a.endpoint == e.Endpoint && !e.rooms[rid] {
+			load += 1
+		}
+	}
+	return load
+}
+
+func (m *Monitor) locate(rid string) *Engine {
+	m.Lock()
+	defer m.Unlock()
+
+	if a := m.rooms[rid]; a != nil {
+		e := m.engines[a.endpoint]
+		if e != nil && !e.State.Draining {
+			a.at = time.Now()
+			return e.copy()
+		}
+	}
+
+	var best *Engine
+	var least int
+	for _, e := range m.enginesSorted() {
+		if e.State.Draining {
+			continue
+		}
+		if load := m.load(e); best == nil || load < least {
+			best, least = e, load
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	m.rooms[rid] = &assignment{endpoint: best.Endpoint, at: time.Now()}
+	logger.Printf("monitor.locate(%s) => %s with load %d\n", rid, best.Endpoint, least)
+	return best.copy()
+}
+
+func (m *Monitor) list() []*Engine {
+	m.Lock()
+	defer m.Unlock()
+
+	engines := m.enginesSorted()
+	for i, e := range engines {
+		engines[i] = e.copy()
+	}
+	return engines
+}
+
+func (m *Monitor) enginesSorted() []*Engine {
+	engines := make([]*Engine, 0, len(m.engines))
+	for _, e := range m.engines {
+		engines = append(engines, e)
+	}
+	sort.Slice(engines, func(i, j int) bool {
+		return engines[i].Endpoint < engines[j].Endpoint
+	})
+	return engines
+}
+
+// Loop evicts the engines without heartbeat, and the room assignments
+// never confirmed by their engine
+func (m *Monitor) Loop() {
+	for {
+		time.Sleep(m.timeout / 3)
+		m.evict(time.Now())
+	}
+}
+
+func (m *Monitor) evict(now time.Time) {
+	m.Lock()
+	defer m.Unlock()
+
+	for endpoint, e := range m.engines {
+		if now.Sub(e.HeartbeatAt) > m.timeout {
+			delete(m.engines, endpoint)
+			logger.Printf("monitor.evict(%s)\n", endpoint)
+		}
+	}
+	for rid, a := range m.rooms {
+		e := m.engines[a.endpoint]
+		if e == nil || (!e.rooms[rid] && now.Sub(a.at) > monitorAssignGrace) {
+			delete(m.rooms, rid)
+		}
+	}
+}
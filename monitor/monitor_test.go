@@ -0,0 +1,152 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MixinNetwork/kraken/engine"
+)
+
+const (
+	engineA = "http://127.0.0.1:7001"
+	engineB = "http://127.0.0.1:7002"
+	engineC = "http://127.0.0.1:7003"
+)
+
+func TestMonitorLeastLoaded(t *testing.T) {
+	m := NewMonitor(&Configuration{})
+	m.heartbeat(engineA, engine.State{ActivePeers: 8}, []string{"a"})
+	m.heartbeat(engineB, engine.State{ActivePeers: 2, ActiveListeners: 1}, []string{"b"})
+	m.heartbeat(engineC, engine.State{ActivePeers: 5}, []string{"c"})
+
+	assertLocate(t, m, "r1", engineB)
+	assertLocate(t, m, "r2", engineB)
+	assertLocate(t, m, "r3", engineB)
+	// the pending rooms count as load on B until its next heartbeat
+	assertLocate(t, m, "r4", engineC)
+	m.heartbeat(engineB, engine.State{ActivePeers: 3}, []string{"b", "r1", "r2", "r3"})
+	assertLocate(t, m, "r5", engineB)
+
+	m.heartbeat(engineB, engine.State{Draining: true}, nil)
+	m.heartbeat(engineC, engine.State{Draining: true}, nil)
+	m.heartbeat(engineA, engine.State{Draining: true}, nil)
+	if e := m.locate("r7"); e != nil {
+		t.Fatalf("locate(r7) => %s with all engines draining", e.Endpoint)
+	}
+}
+
+func TestMonitorSticky(t *testing.T) {
+	m := NewMonitor(&Configuration{})
+	m.heartbeat(engineA, engine.State{ActivePeers: 1}, nil)
+	m.heartbeat(engineB, engine.State{ActivePeers: 4}, nil)
+
+	assertLocate(t, m, "r1", engineA)
+	m.heartbeat(engineA, engine.State{ActivePeers: 20}, []string{"r1"})
+	assertLocate(t, m, "r1", engineA)
+	assertLocate(t, m, "r2", engineB)
+
+	// a room reported by another engine never steals the assignment
+	m.heartbeat(engineB, engine.State{ActivePeers: 4}, []string{"r1", "r2"})
+	assertLocate(t, m, "r1", engineA)
+
+	// unless the engine of the assignment no longer hosts the room
+	m.heartbeat(engineA, engine.State{ActivePeers: 20}, nil)
+	m.heartbeat(engineB, engine.State{ActivePeers: 4}, []string{"r1", "r2"})
+	assertLocate(t, m, "r1", engineB)
+}
+
+func TestMonitorDrainingFailover(t *testing.T) {
+	m := NewMonitor(&Configuration{})
+	m.heartbeat(engineA, engine.State{ActivePeers: 1}, []string{"r1"})
+	m.heartbeat(engineB, engine.State{ActivePeers: 9}, []string{"r2"})
+	assertLocate(t, m, "r1", engineA)
+
+	m.heartbeat(engineA, engine.State{ActivePeers: 1, Draining: true}, []string{"r1"})
+	assertLocate(t, m, "r1", engineB)
+	assertLocate(t, m, "r3", engineB)
+
+	// the draining engine still reports r1, but keeps away from the new one
+	m.heartbeat(engineA, engine.State{ActivePeers: 1, Draining: true}, []string{"r1"})
+	assertLocate(t, m, "r1", engineB)
+}
+
+func TestMonitorEviction(t *testing.T) {
+	conf := &Configuration{}
+	conf.Monitor.Timeout = 10
+	m := NewMonitor(conf)
+	m.heartbeat(engineA, engine.State{ActivePeers: 1}, []string{"r1"})
+	m.heartbeat(engineB, engine.State{ActivePeers: 9}, []string{"r2"})
+	assertLocate(t, m, "r1", engineA)
+	assertLocate(t, m, "r3", engineA)
+
+	m.evict(time.Now().Add(5 * time.Second))
+	if len(m.list()) != 2 {
+		t.Fatalf("evict before timeout => %d engines", len(m.list()))
+	}
+
+	m.engines[engineA].HeartbeatAt = time.Now().Add(-11 * time.Second)
+	m.evict(time.Now())
+	engines := m.list()
+	if len(engines) != 1 || engines[0].Endpoint != engineB {
+		t.Fatalf("evict(%s) => %d engines", engineA, len(engines))
+	}
+	if m.rooms["r1"] != nil || m.rooms["r3"] != nil {
+		t.Fatalf("evict(%s) keeps its rooms", engineA)
+	}
+	assertLocate(t, m, "r1", engineB)
+
+	// an assignment never confirmed by its engine expires after the grace
+	m.rooms["r1"].at = time.Now().Add(-monitorAssignGrace - time.Second)
+	m.rooms["r2"].at = time.Now().Add(-monitorAssignGrace - time.Second)
+	m.evict(time.Now())
+	if m.rooms["r1"] != nil {
+		t.Fatalf("evict keeps the unconfirmed r1")
+	}
+	if m.rooms["r2"] == nil {
+		t.Fatalf("evict drops the confirmed r2")
+	}
+}
+
+func assertLocate(t *testing.T, m *Monitor, rid, endpoint string) {
+	t.Helper()
+
+	e := m.locate(rid)
+	if e == nil {
+		t.Fatalf("locate(%s) => nil, expect %s", rid, endpoint)
+	}
+	if e.Endpoint != endpoint {
+		t.Fatalf("locate(%s) => %s, expect %s", rid, e.Endpoint, endpoint)
+	}
+}
+
+func TestMonitorConcurrent(t *testing.T) {
+	m := NewMonitor(&Configuration{})
+	m.heartbeat(engineA, engine.State{ActivePeers: 1}, nil)
+
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := range 100 {
+				m.heartbeat(engineA, engine.State{ActivePeers: j}, []string{fmt.Sprintf("r%d", i)})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := range 100 {
+				e := m.locate(fmt.Sprintf("r%d-%d", i, j))
+				if _, err := json.Marshal(e); err != nil {
+					t.Error(err)
+				}
+				if _, err := json.Marshal(m.list()); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,171 @@
+package monitor
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/MixinNetwork/kraken/engine"
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/dimfeld/httptreemux/v5"
+	"github.com/gorilla/handlers"
+	"github.com/unrolled/render"
+)
+
+const (
+	ErrorInvalidParams = 5001000
+	ErrorUnauthorized  = 5004000
+	ErrorNoEngine      = 5005000
+)
+
+type R struct {
+	monitor *Monitor
+	conf    *Configuration
+}
+
+func buildError(code int, err error) error {
+	status := http.StatusAccepted
+	switch code {
+	case ErrorUnauthorized:
+		status = http.StatusUnauthorized
+	case ErrorNoEngine:
+		status = http.StatusServiceUnavailable
+	}
+	return engine.Error{
+		Status:      status,
+		Code:        code,
+		Description: err.Error(),
+	}
+}
+
+// authorize checks the engine secret for heartbeat, and the client secret
+// for everything else, so a client is never able to register an engine
+func (impl *R) authorize(r *http.Request, method string) error {
+	secret := impl.conf.Monitor.ClientSecret
+	if method == "heartbeat" {
+		secret = impl.conf.Monitor.EngineSecret
+	}
+	if secret == "" {
+		return nil
+	}
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1 {
+		return nil
+	}
+	return buildError(ErrorUnauthorized, fmt.Errorf("invalid monitor secret for %s", method))
+}
+
+func (impl *R) root(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	if err := impl.authorize(r, "engines"); err != nil {
+		renderJSON(w, http.StatusOK, map[string]any{"error": err})
+		return
+	}
+	renderJSON(w, http.StatusOK, map[string]any{"data": map[string]any{"engines": impl.monitor.list()}})
+}
+
+func (impl *R) handle(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	var call engine.Call
+	if err := json.NewDecoder(r.Body).Decode(&call); err != nil {
+		renderJSON(w, http.StatusBadRequest, map[string]any{"error": err.Error()})
+		return
+	}
+	startAt := time.Now()
+	data, err := impl.dispatch(r, &call)
+	if err != nil {
+		logger.Printf("RPC.handle(id: %s, method: %s, time: %f) ERROR %s\n",
+			call.Id, call.Method, time.Since(startAt).Seconds(), err.Error())
+		renderJSON(w, http.StatusOK, map[string]any{"id": call.Id, "error": err})
+		return
+	}
+	logger.Verbosef("RPC.handle(id: %s, method: %s, time: %f) OK\n",
+		call.Id, call.Method, time.Since(startAt).Seconds())
+	renderJSON(w, http.StatusOK, map[string]any{"id": call.Id, "data": data})
+}
+
+func (impl *R) dispatch(r *http.Request, call *engine.Call) (any, error) {
+	if err := impl.authorize(r, call.Method); err != nil {
+		return nil, err
+	}
+	switch call.Method {
+	case "heartbeat":
+		return impl.heartbeat(call.Params)
+	case "locate":
+		return impl.locate(call.Params)
+	case "engines":
+		return map[string]any{"engines": impl.monitor.list()}, nil
+	default:
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid method %s", call.Method))
+	}
+}
+
+func (impl *R) heartbeat(params []any) (any, error) {
+	if len(params) != 3 {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
+	}
+	endpoint, ok := params[0].(string)
+	if !ok || !strings.HasPrefix(endpoint, "http") {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid endpoint %v", params[0]))
+	}
+	var state engine.State
+	var rooms []string
+	err := remarshal(params[1], &state)
+	if err != nil {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid state %v", err))
+	}
+	err = remarshal(params[2], &rooms)
+	if err != nil {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid rooms %v", err))
+	}
+	return map[string]any{"engine": impl.monitor.heartbeat(endpoint, state, rooms)}, nil
+}
+
+func (impl *R) locate(params []any) (any, error) {
+	if len(params) != 1 {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
+	}
+	rid, ok := params[0].(string)
+	if !ok || rid == "" {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid rid %v", params[0]))
+	}
+	e := impl.monitor.locate(rid)
+	if e == nil {
+		return nil, buildError(ErrorNoEngine, fmt.Errorf("no engine available for %s", rid))
+	}
+	return map[string]any{"engine": e}, nil
+}
+
+func remarshal(in, out any) error {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
+func renderJSON(w http.ResponseWriter, status int, data any) {
+	err := render.New().JSON(w, status, data)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func ServeRPC(monitor *Monitor, conf *Configuration) error {
+	logger.Printf("ServeRPC(:%d)\n", conf.RPC.Port)
+	impl := &R{monitor: monitor, conf: conf}
+	router := httptreemux.New()
+	router.GET("/", impl.root)
+	router.POST("/", impl.handle)
+	handler := handlers.ProxyHeaders(router)
+
+	server := &http.Server{
+		Addr:         fmt.Sprintf(":%d", conf.RPC.Port),
+		Handler:      handler,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  120 * time.Second,
+	}
+	return server.ListenAndServe()
+}
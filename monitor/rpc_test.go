@@ -0,0 +1,44 @@
+package monitor
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/MixinNetwork/kraken/engine"
+)
+
+func TestAuthorize(t *testing.T) {
+	conf := &Configuration{}
+	conf.Monitor.EngineSecret = "engine"
+	conf.Monitor.ClientSecret = "client"
+	impl := &R{monitor: NewMonitor(conf), conf: conf}
+
+	cases := []struct {
+		method string
+		token  string
+		ok     bool
+	}{
+		{"heartbeat", "engine", true},
+		{"heartbeat", "client", false},
+		{"heartbeat", "", false},
+		{"locate", "client", true},
+		{"locate", "engine", false},
+		{"engines", "client", true},
+		{"engines", "", false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", "/", nil)
+		if c.token != "" {
+			r.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		err := impl.authorize(r, c.method)
+		if c.ok && err != nil {
+			t.Fatalf("authorize(%s, %s) => %v", c.method, c.token, err)
+		}
+		var e engine.Error
+		if !c.ok && (!errors.As(err, &e) || e.Code != ErrorUnauthorized) {
+			t.Fatalf("authorize(%s, %s) => %v", c.method, c.token, err)
+		}
+	}
+}